@@ -190,8 +190,12 @@ fn load_config(common_args: &CommonArgs, debug_args: &DebugArgs) -> anyhow::Resu
     // Generate unique log file ID for this instance
     let log_file_id = rand_string(8);
 
-    let profile_path = home_dir.join(".anylinuxfs");
-    let config_file_path = home_dir.join(".anylinuxfs").join("config.toml");
+    // ANYLINUXFS_HOME relocates the user store (also honored by init-rootfs)
+    let profile_path = match env::var_os("ANYLINUXFS_HOME") {
+        Some(store) if !store.is_empty() => PathBuf::from(store),
+        _ => home_dir.join(".anylinuxfs"),
+    };
+    let config_file_path = profile_path.join("config.toml");
     #[cfg(target_os = "macos")]
     let log_dir = home_dir.join("Library").join("Logs");
     #[cfg(target_os = "linux")]
@@ -502,14 +502,24 @@ pub fn save_preferences(preferences: &PrefsObject, config_file_path: &Path) -> a
 #[derive(Clone, Debug, Default, Deserialize, Serialize)]
 pub struct AlpineConfig {
     pub custom_packages: Vec<String>,
+    /// Extra /etc/apk/repositories lines (applied by init-rootfs)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub repositories: Vec<String>,
 }
 
 impl AlpineConfig {
     fn merge_with(&self, other: &AlpineConfig) -> AlpineConfig {
         let mut custom_packages = BTreeSet::from_iter(self.custom_packages.clone());
         custom_packages.extend(other.custom_packages.clone());
+        let mut repositories = self.repositories.clone();
+        for repo in &other.repositories {
+            if !repositories.contains(repo) {
+                repositories.push(repo.clone());
+            }
+        }
         AlpineConfig {
             custom_packages: custom_packages.into_iter().collect(),
+            repositories,
         }
     }
 }
@@ -577,6 +587,9 @@ pub struct ImageSource {
     pub kernel: KernelSource,
     pub os_type: OSType,
     pub setup_script: Option<String>,
+    /// Additional files to fetch from the FreeBSD ISO (absolute paths)
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub extra_files: Vec<String>,
 }
 
 impl ImageSource {
@@ -617,6 +630,7 @@ impl Default for ImageSource {
             kernel: KernelSource::default(),
             os_type: OSType::Linux,
             setup_script: None,
+            extra_files: Vec::new(),
         }
     }
 }
@@ -372,6 +372,7 @@ mod freebsd {
             serde_json::to_string(&FreeBSDBootstrapConfig {
                 iso_url: iso_image_url.into(),
                 pkgs: vec!["bash".into(), "pidof".into()],
+                extra_files: src.extra_files.clone(),
             })?,
         )
         .context("Failed to write FreeBSD bootstrap config")?;
@@ -557,6 +558,7 @@ mod freebsd {
     struct FreeBSDBootstrapConfig {
         iso_url: String,
         pkgs: Vec<String>,
+        extra_files: Vec<String>,
     }
 
     fn start_freebsd_bootstrap_vm(
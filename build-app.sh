@@ -65,7 +65,24 @@ mkdir -p libexec && cp "vmproxy/target/aarch64-unknown-linux-musl/$BUILD_DIR/vmp
 
 (cd "vmrunner-sys" && cargo build $BUILD_ARGS)
 cp "vmrunner-sys/target/$BUILD_DIR/libvmrunner_sys.a" "vmrunner-sys/target/"
-(cd "init-rootfs" && go build -ldflags="-w -s" -tags containers_image_openpgp -o ../libexec/)
+ANYLINUXFS_VERSION=$(sed -n 's/^version = "\(.*\)"/\1/p' anylinuxfs/Cargo.toml | head -n 1)
+INIT_ROOTFS_LDFLAGS="-w -s -X main.toolVersion=$ANYLINUXFS_VERSION"
+# Pin the NFS launcher script installed by init-rootfs. Without an explicit
+# digest, the script currently at ENTRYPOINT_URL is pinned.
+if [ -n "$ENTRYPOINT_URL" ]; then
+    INIT_ROOTFS_LDFLAGS="$INIT_ROOTFS_LDFLAGS -X main.defaultEntrypointURL=$ENTRYPOINT_URL"
+else
+    ENTRYPOINT_URL="https://raw.githubusercontent.com/nohajc/docker-nfs-server/refs/heads/develop/entrypoint.sh"
+fi
+if [ -z "$ENTRYPOINT_SHA256" ]; then
+    ENTRYPOINT_FILE=$(mktemp)
+    curl -fsSL -o "$ENTRYPOINT_FILE" "$ENTRYPOINT_URL"
+    ENTRYPOINT_SHA256=$(shasum -a 256 "$ENTRYPOINT_FILE" | cut -d ' ' -f 1)
+    rm -f "$ENTRYPOINT_FILE"
+    echo "Pinning $ENTRYPOINT_URL to sha256 $ENTRYPOINT_SHA256"
+fi
+INIT_ROOTFS_LDFLAGS="$INIT_ROOTFS_LDFLAGS -X main.defaultEntrypointSHA256=$ENTRYPOINT_SHA256"
+(cd "init-rootfs" && go build -ldflags="$INIT_ROOTFS_LDFLAGS" -tags containers_image_openpgp -o ../libexec/)
 
 if [[ "$HOST_OS" == "Darwin" ]]; then
     codesign --entitlements "anylinuxfs.entitlements" --force -s - libexec/init-rootfs
@@ -0,0 +1,86 @@
+// Package ratelimit caps the aggregate throughput of downloads. A nil
+// *rate.Limiter doesn't limit anything, so callers can pass the result of
+// New around unconditionally.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// chunk bounds the bytes read at once so that the transfer stays smooth
+// instead of stalling after every large read. It is also the burst size.
+const chunk = 32 * 1024
+
+// New returns a limiter shared by all readers throttled with it, nil
+// (unlimited) if bytesPerSec is not positive.
+func New(bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), chunk)
+}
+
+// Duration is how long n bytes take at the rate of l, zero if unlimited.
+func Duration(l *rate.Limiter, n int64) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+	return time.Duration(float64(n) / float64(l.Limit()) * float64(time.Second))
+}
+
+// Reader throttles reads from r.
+func Reader(ctx context.Context, l *rate.Limiter, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, l: l}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rate.Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := t.l.WaitN(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Transport throttles the response bodies of requests made through base.
+func Transport(base http.RoundTripper, l *rate.Limiter) http.RoundTripper {
+	if l == nil {
+		return base
+	}
+	return &throttledTransport{base: base, l: l}
+}
+
+type throttledTransport struct {
+	base http.RoundTripper
+	l    *rate.Limiter
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{Reader(req.Context(), t.l, resp.Body), resp.Body}
+	return resp, nil
+}
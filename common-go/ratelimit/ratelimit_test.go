@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestNewUnlimited(t *testing.T) {
+	for _, rate := range []int64{0, -1} {
+		if l := New(rate); l != nil {
+			t.Errorf("New(%d) = %v, want nil", rate, l)
+		}
+	}
+	r := bytes.NewReader(nil)
+	if got := Reader(context.Background(), nil, r); got != r {
+		t.Error("Reader with a nil limiter wraps the reader")
+	}
+	if got := Duration(nil, 1<<20); got != 0 {
+		t.Errorf("Duration(nil) = %v, want 0", got)
+	}
+}
+
+func TestDuration(t *testing.T) {
+	if got, want := Duration(New(1<<20), 10<<20), 10*time.Second; got != want {
+		t.Errorf("Duration = %v, want %v", got, want)
+	}
+}
+
+func TestReaderThrottles(t *testing.T) {
+	const rate = 256 * 1024
+	data := make([]byte, 3*chunk)
+	start := time.Now()
+	got, err := io.ReadAll(Reader(context.Background(), New(rate), bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("read %d bytes, want %d", len(got), len(data))
+	}
+	// the first chunk is the burst, the rest is paced
+	if elapsed, want := time.Since(start), Duration(New(rate), int64(len(data)-chunk)); elapsed < want*9/10 {
+		t.Errorf("read took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestReaderCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := Reader(ctx, New(1), bytes.NewReader(make([]byte, 2*chunk)))
+	if _, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReadAll = %v, want context.Canceled", err)
+	}
+}
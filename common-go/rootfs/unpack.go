@@ -0,0 +1,23 @@
+// Package rootfs holds the settings both init-rootfs and freebsd-bootstrap
+// unpack OCI images with, so that the Linux and FreeBSD rootfs layouts
+// match.
+package rootfs
+
+import "github.com/opencontainers/umoci/oci/layer"
+
+// UnpackOptions returns the layer options every rootfs is unpacked with.
+// Only the ID mappings are meant to vary between callers.
+//
+//   - KeepDirlinks must stay on: base images replace directories with
+//     symlinks (e.g. /lib -> usr/lib on a merged /usr) and later layers
+//     writing through the link would otherwise turn it back into a directory.
+//   - WhiteoutMode must stay OCIStandardWhiteout: the rootfs is used
+//     directly, not as an overlayfs lower layer, so whiteouts have to be
+//     applied rather than stored as device nodes.
+func UnpackOptions(mapOptions layer.MapOptions) layer.UnpackOptions {
+	return layer.UnpackOptions{
+		MapOptions:   mapOptions,
+		KeepDirlinks: true,
+		WhiteoutMode: layer.OCIStandardWhiteout,
+	}
+}
@@ -0,0 +1,26 @@
+package rootfs
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+func TestUnpackOptions(t *testing.T) {
+	mapOptions := layer.MapOptions{
+		UIDMappings: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 501, Size: 1}},
+		GIDMappings: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 20, Size: 1}},
+		Rootless:    true,
+	}
+	opts := UnpackOptions(mapOptions)
+	if !opts.KeepDirlinks {
+		t.Error("KeepDirlinks is off")
+	}
+	if opts.WhiteoutMode != layer.OCIStandardWhiteout {
+		t.Errorf("WhiteoutMode = %v, want OCIStandardWhiteout", opts.WhiteoutMode)
+	}
+	if !opts.MapOptions.Rootless || len(opts.MapOptions.UIDMappings) != 1 || opts.MapOptions.GIDMappings[0].HostID != 20 {
+		t.Errorf("MapOptions = %+v, want %+v", opts.MapOptions, mapOptions)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"anylinuxfs/freebsd-bootstrap/remoteiso"
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// transferStats is a snapshot (or difference) of the remoteiso request
+// counters and the ISO cache statistics.
+type transferStats struct {
+	Bytes       int64
+	Requests    int64
+	CacheHits   int64
+	CacheMisses int64
+}
+
+func currentTransferStats(cache *remoteiso.CachedReaderAt) transferStats {
+	cacheStats := cache.Stats()
+	return transferStats{
+		Bytes:       remoteiso.TotalBytesRead.Load(),
+		Requests:    remoteiso.TotalRequests.Load(),
+		CacheHits:   cacheStats.Hits,
+		CacheMisses: cacheStats.Misses,
+	}
+}
+
+func (s transferStats) sub(o transferStats) transferStats {
+	return transferStats{
+		Bytes:       s.Bytes - o.Bytes,
+		Requests:    s.Requests - o.Requests,
+		CacheHits:   s.CacheHits - o.CacheHits,
+		CacheMisses: s.CacheMisses - o.CacheMisses,
+	}
+}
+
+func (s transferStats) add(o transferStats) transferStats {
+	return transferStats{
+		Bytes:       s.Bytes + o.Bytes,
+		Requests:    s.Requests + o.Requests,
+		CacheHits:   s.CacheHits + o.CacheHits,
+		CacheMisses: s.CacheMisses + o.CacheMisses,
+	}
+}
+
+func (s transferStats) hitRatio() string {
+	blocks := s.CacheHits + s.CacheMisses
+	if blocks == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(s.CacheHits)*100/float64(blocks))
+}
+
+type fileTransfer struct {
+	phase string
+	path  string
+	size  int64
+	transferStats
+}
+
+// accounting attributes ISO reads to the downloaded files, grouped by
+// phase. A nil *accounting records nothing.
+type accounting struct {
+	cache *remoteiso.CachedReaderAt
+	start transferStats
+	files []fileTransfer
+}
+
+func newAccounting(cache *remoteiso.CachedReaderAt) *accounting {
+	return &accounting{cache: cache, start: currentTransferStats(cache)}
+}
+
+// snapshot returns the current counters (zero for a nil *accounting).
+func (a *accounting) snapshot() transferStats {
+	if a == nil {
+		return transferStats{}
+	}
+	return currentTransferStats(a.cache)
+}
+
+func (a *accounting) record(phase string, entry *remoteiso.FileEntry, stats transferStats) {
+	if a == nil {
+		return
+	}
+	a.files = append(a.files, fileTransfer{
+		phase:         phase,
+		path:          entry.Path,
+		size:          entry.File.Size(),
+		transferStats: stats,
+	})
+}
+
+// print writes per-phase and per-file tables. Reads not attributed to any
+// file (directory records, ELF headers of dry-run lookups) are listed as
+// lookups.
+func (a *accounting) print() {
+	if a == nil {
+		return
+	}
+	var phases []string
+	byPhase := map[string]transferStats{}
+	fileCount := map[string]int{}
+	var attributed transferStats
+	for _, f := range a.files {
+		if _, ok := byPhase[f.phase]; !ok {
+			phases = append(phases, f.phase)
+		}
+		byPhase[f.phase] = byPhase[f.phase].add(f.transferStats)
+		fileCount[f.phase]++
+		attributed = attributed.add(f.transferStats)
+	}
+	total := a.snapshot().sub(a.start)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nPhase\tFiles\tBytes\tRequests\tCache hits\t")
+	for _, phase := range phases {
+		s := byPhase[phase]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t\n", phase, fileCount[phase], s.Bytes, s.Requests, s.hitRatio())
+	}
+	lookups := total.sub(attributed)
+	fmt.Fprintf(w, "lookups\t-\t%d\t%d\t%s\t\n", lookups.Bytes, lookups.Requests, lookups.hitRatio())
+	fmt.Fprintf(w, "total\t%d\t%d\t%d\t%s\t\n", len(a.files), total.Bytes, total.Requests, total.hitRatio())
+	w.Flush()
+
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nFile\tSize\tBytes read\tRequests\tCache hits\t")
+	for _, f := range a.files {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t\n", f.path, f.size, f.Bytes, f.Requests, f.hitRatio())
+	}
+	w.Flush()
+}
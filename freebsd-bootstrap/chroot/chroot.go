@@ -29,7 +29,25 @@ type chrootError struct {
 }
 
 func (e *chrootError) Error() string {
-	return "chroot " + e.path + ": " + e.err.Error()
+	msg := "chroot " + e.path + ": " + e.err.Error()
+	if hint := e.Hint(); hint != "" {
+		msg += " (" + hint + ")"
+	}
+	return msg
+}
+
+// Hint returns a human-readable suggestion for common failure causes
+// or an empty string if there is nothing more to add.
+func (e *chrootError) Hint() string {
+	switch {
+	case errors.Is(e.err, unix.EPERM):
+		return "insufficient privileges, must run as root"
+	case errors.Is(e.err, unix.ENOENT):
+		return "target directory does not exist"
+	case errors.Is(e.err, unix.ENOTDIR):
+		return "a component of the path is not a directory"
+	}
+	return ""
 }
 
 // Cause exposes underlying error (pkg/errors convention).
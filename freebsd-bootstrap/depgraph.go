@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// depGraph records what the downloader resolved: files needing other files
+// (interpreters, symlink targets) or library names, and library names
+// resolved to ISO paths. Nodes that were never resolved stay in the graph so
+// that gaps in the dependency closure are visible. A nil *depGraph records
+// nothing.
+type depGraph struct {
+	roots []string
+	// found holds the ISO paths which exist in the image
+	found map[string]struct{}
+	// libs holds the nodes which are library names rather than paths
+	libs  map[string]struct{}
+	edges map[string]map[string]struct{}
+}
+
+func newDepGraph() *depGraph {
+	return &depGraph{
+		found: make(map[string]struct{}),
+		libs:  make(map[string]struct{}),
+		edges: make(map[string]map[string]struct{}),
+	}
+}
+
+func (g *depGraph) addRoot(p string) {
+	if g != nil {
+		g.roots = append(g.roots, p)
+	}
+}
+
+func (g *depGraph) addFound(p string) {
+	if g != nil {
+		g.found[p] = struct{}{}
+	}
+}
+
+func (g *depGraph) addEdge(from, to string) {
+	if g == nil {
+		return
+	}
+	if g.edges[from] == nil {
+		g.edges[from] = make(map[string]struct{})
+	}
+	g.edges[from][to] = struct{}{}
+}
+
+func (g *depGraph) addLibrary(from, name string) {
+	if g != nil {
+		g.libs[name] = struct{}{}
+		g.addEdge(from, name)
+	}
+}
+
+type depNode struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"` // "file" or "library"
+	Resolved bool   `json:"resolved"`
+}
+
+type depEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// nodes returns all nodes sorted by id. A file is resolved if it was found
+// in the ISO, a library if at least one of its candidate paths was.
+func (g *depGraph) nodes() []depNode {
+	ids := map[string]struct{}{}
+	for _, r := range g.roots {
+		ids[r] = struct{}{}
+	}
+	for from, tos := range g.edges {
+		ids[from] = struct{}{}
+		for to := range tos {
+			ids[to] = struct{}{}
+		}
+	}
+	var nodes []depNode
+	for _, id := range slices.Sorted(maps.Keys(ids)) {
+		n := depNode{ID: id, Kind: "file"}
+		if _, ok := g.libs[id]; ok {
+			n.Kind = "library"
+			n.Resolved = len(g.edges[id]) > 0
+		} else {
+			_, n.Resolved = g.found[id]
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func (g *depGraph) sortedEdges() []depEdge {
+	var edges []depEdge
+	for _, from := range slices.Sorted(maps.Keys(g.edges)) {
+		for _, to := range slices.Sorted(maps.Keys(g.edges[from])) {
+			edges = append(edges, depEdge{From: from, To: to})
+		}
+	}
+	return edges
+}
+
+func (g *depGraph) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Roots []string  `json:"roots"`
+		Nodes []depNode `json:"nodes"`
+		Edges []depEdge `json:"edges"`
+	}{g.roots, g.nodes(), g.sortedEdges()})
+}
+
+// writeDOT draws library names as boxes and unresolved nodes in red.
+func (g *depGraph) writeDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph dependencies {\n\trankdir=LR;\n")
+	for _, n := range g.nodes() {
+		var attrs []string
+		if n.Kind == "library" {
+			attrs = append(attrs, "shape=box")
+		}
+		if !n.Resolved {
+			attrs = append(attrs, "color=red", "style=dashed")
+		}
+		fmt.Fprintf(&b, "\t%q [%s];\n", n.ID, strings.Join(attrs, ","))
+	}
+	for _, e := range g.sortedEdges() {
+		fmt.Fprintf(&b, "\t%q -> %q;\n", e.From, e.To)
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// runDepsGraph resolves the dependency closure of the required files the
+// same way the dry run does and writes it to outPath, as JSON if the name
+// ends in .json and as DOT otherwise.
+func runDepsGraph(config Config, outPath string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	graph := newDepGraph()
+	if _, err := resolvePlan(ctx, config, graph); err != nil {
+		return err
+	}
+
+	f, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	if path.Ext(outPath) == ".json" {
+		err = graph.writeJSON(f)
+	} else {
+		err = graph.writeDOT(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", outPath, err)
+	}
+	fmt.Printf("Wrote dependency graph to %s\n", outPath)
+	return nil
+}
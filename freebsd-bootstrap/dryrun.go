@@ -0,0 +1,68 @@
+package main
+
+import (
+	"anylinuxfs/freebsd-bootstrap/remoteiso"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// runDryRun resolves the full set of files the bootstrap would fetch from
+// the ISO (reading only directory records and ELF headers) and prints it
+// together with the disk commands, without writing anything.
+func runDryRun(config Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	plan, err := resolvePlan(ctx, config, nil)
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(plan, func(a, b *remoteiso.FileEntry) int { return strings.Compare(a.Path, b.Path) })
+	fmt.Println("\nFiles to fetch from the ISO:")
+	var total int64
+	for _, entry := range plan {
+		if entry.File.Mode()&os.ModeSymlink != 0 {
+			fmt.Printf("  %s -> %s\n", entry.Path, entry.File.SymlinkTarget())
+			continue
+		}
+		fmt.Printf("  %s (%d bytes)\n", entry.Path, entry.File.Size())
+		total += entry.File.Size()
+	}
+	fmt.Printf("Total: %d files, %d bytes\n", len(plan), total)
+	fmt.Println("(kernel module dependencies are resolved from the bundled modules at runtime and not included)")
+
+	fmt.Println("\nDisk preparation:")
+	return partitionDisk("vtbd1")
+}
+
+// resolvePlan returns the files the bootstrap would fetch from the ISO,
+// recording their dependencies in graph.
+func resolvePlan(ctx context.Context, config Config, graph *depGraph) ([]*remoteiso.FileEntry, error) {
+	root, _, err := openISO(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	requiredFiles := slices.Concat(RequiredFiles, config.ExtraFiles)
+	match := remoteiso.MatchOptions{CaseSensitive: config.CaseSensitiveISONames}
+	foundFiles := remoteiso.FindFiles(root, requiredFiles, match)
+	warnMissingFiles(root, config, foundFiles, match)
+	for _, path := range requiredFiles {
+		graph.addRoot(path)
+	}
+
+	var plan []*remoteiso.FileEntry
+	d := newDownloader("", root, match)
+	d.plan = &plan
+	d.graph = graph
+	if err := d.downloadWithDependencies(ctx, foundFiles); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
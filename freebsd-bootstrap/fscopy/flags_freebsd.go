@@ -0,0 +1,18 @@
+package fscopy
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// setFlags copies the file flags (schg, nodump, ...) of st to path.
+func setFlags(path string, st *unix.Stat_t) error {
+	if st.Flags == 0 {
+		return nil
+	}
+	if err := unix.Chflags(path, int(st.Flags)); err != nil {
+		return fmt.Errorf("chflags %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+// Package fscopy copies a directory tree the way `cp -ax` does: ownership,
+// modes, timestamps, file flags, symlinks and hard links are preserved and
+// mount points below the source are created but not descended into.
+package fscopy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	DefaultBufferSize = 1024 * 1024
+	DefaultWorkers    = 4
+)
+
+type Options struct {
+	// BufferSize used for copying file contents, DefaultBufferSize if zero
+	BufferSize int
+	// Workers copying regular files concurrently, DefaultWorkers if zero
+	Workers int
+	// ProgressInterval between progress lines, no progress output if zero
+	ProgressInterval time.Duration
+	// Progress, if set, is called every ProgressInterval instead of printing
+	// a progress line
+	Progress func(Stats)
+}
+
+// Stats summarizes a finished (or failed) copy.
+type Stats struct {
+	Files   int64 // regular files copied
+	Bytes   int64 // bytes of regular files copied
+	Skipped int64 // regular files already up to date in the destination
+}
+
+type hardLink struct {
+	target string // destination path of the first copy
+	path   string
+}
+
+type copier struct {
+	src, dst string
+	srcDev   uint64
+	opts     Options
+
+	files   atomic.Int64
+	bytes   atomic.Int64
+	skipped atomic.Int64
+
+	jobs  chan string
+	links []hardLink
+	// inodes maps (dev, ino) of multiply linked files to their first path
+	inodes map[[2]uint64]string
+	dirs   []string
+
+	errOnce sync.Once
+	err     error
+	failed  atomic.Bool
+}
+
+// Copy copies the contents of src into the existing directory dst.
+//
+// Copying can be resumed: regular files whose size and modification time
+// already match are skipped, so rerunning after an interruption only copies
+// what is missing. Device nodes and sockets are skipped with a warning since
+// FreeBSD only supports device nodes on devfs; FIFOs are recreated.
+func Copy(src, dst string, opts Options) (Stats, error) {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		return Stats{}, fmt.Errorf("stat %s: %w", src, err)
+	}
+	c := &copier{
+		src:    filepath.Clean(src),
+		dst:    filepath.Clean(dst),
+		srcDev: uint64(st.Dev),
+		opts:   opts,
+		jobs:   make(chan string, opts.Workers*4),
+		inodes: make(map[[2]uint64]string),
+	}
+
+	stopProgress := c.startProgress()
+	var wg sync.WaitGroup
+	for range opts.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, opts.BufferSize)
+			for rel := range c.jobs {
+				if c.failed.Load() {
+					continue
+				}
+				if err := c.copyFile(rel, buf); err != nil {
+					c.fail(err)
+				}
+			}
+		}()
+	}
+
+	c.fail(c.walk("."))
+	close(c.jobs)
+	wg.Wait()
+	stopProgress()
+
+	if c.err == nil {
+		c.fail(c.finish())
+	}
+	return c.stats(), c.err
+}
+
+func (c *copier) stats() Stats {
+	return Stats{Files: c.files.Load(), Bytes: c.bytes.Load(), Skipped: c.skipped.Load()}
+}
+
+func (c *copier) fail(err error) {
+	if err == nil {
+		return
+	}
+	c.errOnce.Do(func() {
+		c.err = err
+		c.failed.Store(true)
+	})
+}
+
+func (c *copier) startProgress() func() {
+	if c.opts.ProgressInterval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	ticker := time.NewTicker(c.opts.ProgressInterval)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				s := c.stats()
+				if c.opts.Progress != nil {
+					c.opts.Progress(s)
+					continue
+				}
+				fmt.Printf("Copied %d files (%d MiB), %d up to date\n", s.Files, s.Bytes>>20, s.Skipped)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// walk creates directories, symlinks and special files as it goes and hands
+// regular files to the workers. Hard links are created once all files exist.
+func (c *copier) walk(rel string) error {
+	if c.failed.Load() {
+		return nil
+	}
+	srcPath := filepath.Join(c.src, rel)
+	dstPath := filepath.Join(c.dst, rel)
+
+	var st unix.Stat_t
+	if err := unix.Lstat(srcPath, &st); err != nil {
+		return fmt.Errorf("stat %s: %w", srcPath, err)
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		if err := os.Mkdir(dstPath, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		c.dirs = append(c.dirs, rel)
+		// mount points (and the destination itself) stay empty
+		if uint64(st.Dev) != c.srcDev || srcPath == c.dst {
+			return nil
+		}
+		entries, err := os.ReadDir(srcPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := c.walk(filepath.Join(rel, e.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case unix.S_IFREG:
+		if st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), st.Ino}
+			if first, ok := c.inodes[key]; ok {
+				c.links = append(c.links, hardLink{target: first, path: rel})
+				return nil
+			}
+			c.inodes[key] = rel
+		}
+		c.jobs <- rel
+		return nil
+
+	case unix.S_IFLNK:
+		target, err := os.Readlink(srcPath)
+		if err != nil {
+			return err
+		}
+		if current, err := os.Readlink(dstPath); err == nil && current == target {
+			return nil
+		}
+		if err := removeExisting(dstPath); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dstPath); err != nil {
+			return err
+		}
+		return c.applyMetadata(dstPath, &st)
+
+	case unix.S_IFIFO:
+		if err := removeExisting(dstPath); err != nil {
+			return err
+		}
+		if err := unix.Mkfifo(dstPath, 0600); err != nil {
+			return fmt.Errorf("mkfifo %s: %w", dstPath, err)
+		}
+		return c.applyMetadata(dstPath, &st)
+
+	default:
+		fmt.Printf("Warning: skipping special file %s\n", srcPath)
+		return nil
+	}
+}
+
+// upToDate reports whether dst is a regular file matching st in size and
+// modification time (set last when a copy completes).
+func upToDate(dstPath string, st *unix.Stat_t) bool {
+	var dst unix.Stat_t
+	if err := unix.Lstat(dstPath, &dst); err != nil {
+		return false
+	}
+	return dst.Mode&unix.S_IFMT == unix.S_IFREG && dst.Size == st.Size && dst.Mtim == st.Mtim
+}
+
+func (c *copier) copyFile(rel string, buf []byte) error {
+	srcPath := filepath.Join(c.src, rel)
+	dstPath := filepath.Join(c.dst, rel)
+
+	in, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var st unix.Stat_t
+	if err := unix.Fstat(int(in.Fd()), &st); err != nil {
+		return fmt.Errorf("stat %s: %w", srcPath, err)
+	}
+	if upToDate(dstPath, &st) {
+		c.skipped.Add(1)
+		return nil
+	}
+
+	if err := removeExisting(dstPath); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	// hide ReadFrom so that the configured buffer size is honored
+	n, err := io.CopyBuffer(struct{ io.Writer }{out}, in, buf)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("copy %s: %w", srcPath, err)
+	}
+
+	c.files.Add(1)
+	c.bytes.Add(n)
+	return c.applyMetadata(dstPath, &st)
+}
+
+// finish creates hard links and then applies directory metadata deepest
+// first, so that creating entries doesn't bump directory timestamps again.
+func (c *copier) finish() error {
+	for _, l := range c.links {
+		dstPath := filepath.Join(c.dst, l.path)
+		if err := removeExisting(dstPath); err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(c.dst, l.target), dstPath); err != nil {
+			return err
+		}
+	}
+
+	for _, rel := range slices.Backward(c.dirs) {
+		var st unix.Stat_t
+		if err := unix.Lstat(filepath.Join(c.src, rel), &st); err != nil {
+			return fmt.Errorf("stat %s: %w", filepath.Join(c.src, rel), err)
+		}
+		if err := c.applyMetadata(filepath.Join(c.dst, rel), &st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMetadata copies ownership, mode, timestamps and file flags. Mode is
+// set after ownership because chown clears the setuid and setgid bits.
+func (c *copier) applyMetadata(path string, st *unix.Stat_t) error {
+	if err := unix.Lchown(path, int(st.Uid), int(st.Gid)); err != nil {
+		return fmt.Errorf("chown %s: %w", path, err)
+	}
+	isLink := st.Mode&unix.S_IFMT == unix.S_IFLNK
+	if !isLink {
+		if err := unix.Chmod(path, uint32(st.Mode&^unix.S_IFMT)); err != nil {
+			return fmt.Errorf("chmod %s: %w", path, err)
+		}
+	}
+	ts := []unix.Timespec{st.Atim, st.Mtim}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("set times of %s: %w", path, err)
+	}
+	if !isLink {
+		return setFlags(path, st)
+	}
+	return nil
+}
+
+func removeExisting(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
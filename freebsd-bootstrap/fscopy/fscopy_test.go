@@ -0,0 +1,204 @@
+package fscopy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tree describes the files of a test directory; symlinks are created
+// after regular files and directories.
+type tree struct {
+	dirs     map[string]os.FileMode
+	files    map[string]os.FileMode
+	symlinks map[string]string
+}
+
+// content is what each regular file contains.
+func content(name string) []byte {
+	return []byte("contents of " + name + "\n")
+}
+
+func (tr tree) create(t *testing.T, root string) {
+	t.Helper()
+	for name := range tr.dirs {
+		if err := os.MkdirAll(filepath.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, mode := range tr.files {
+		path := filepath.Join(root, name)
+		if err := os.WriteFile(path, content(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// explicit chmod since WriteFile is subject to umask
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range tr.symlinks {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// directory modes last, a read-only directory can't be filled
+	for name, mode := range tr.dirs {
+		if err := os.Chmod(filepath.Join(root, name), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func copyTree(t *testing.T, src, dst string) Stats {
+	t.Helper()
+	stats, err := Copy(src, dst, Options{Workers: 2, BufferSize: 7})
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	return stats
+}
+
+func lstat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestCopyPreservesModesAndSymlinks(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	tr := tree{
+		dirs: map[string]os.FileMode{
+			"etc":          0755,
+			"private":      0700,
+			"usr/lib":      0755,
+			"usr/share/ro": 0555,
+		},
+		files: map[string]os.FileMode{
+			"etc/rc.conf":      0644,
+			"private/key":      0600,
+			"usr/lib/libc.so7": 0444,
+			"usr/bin-setuid":   0755 | os.ModeSetuid,
+			"usr/group-only":   0750 | os.ModeSetgid,
+		},
+		symlinks: map[string]string{
+			"usr/lib/libc.so": "libc.so7",
+			"etc/abs":         "/etc/rc.conf",
+			"etc/dangling":    "../nowhere",
+			"usr/dirlink":     "lib",
+		},
+	}
+	tr.create(t, src)
+	// distinct timestamps, which must survive the copy
+	old := time.Date(2001, 2, 3, 4, 5, 6, 7000, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "etc/rc.conf"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := copyTree(t, src, dst)
+	if stats.Files != int64(len(tr.files)) || stats.Skipped != 0 {
+		t.Errorf("stats = %+v, want %d files copied", stats, len(tr.files))
+	}
+
+	for name, mode := range tr.files {
+		info := lstat(t, filepath.Join(dst, name))
+		if info.Mode() != mode {
+			t.Errorf("%s: mode %v, want %v", name, info.Mode(), mode)
+		}
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content(name)) {
+			t.Errorf("%s: contents %q", name, got)
+		}
+		if srcTime := lstat(t, filepath.Join(src, name)).ModTime(); !info.ModTime().Equal(srcTime) {
+			t.Errorf("%s: mtime %v, want %v", name, info.ModTime(), srcTime)
+		}
+	}
+	for name, mode := range tr.dirs {
+		if info := lstat(t, filepath.Join(dst, name)); info.Mode() != os.ModeDir|mode {
+			t.Errorf("%s: mode %v, want %v", name, info.Mode(), os.ModeDir|mode)
+		}
+	}
+	for name, target := range tr.symlinks {
+		if info := lstat(t, filepath.Join(dst, name)); info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s: not copied as a symlink (mode %v)", name, info.Mode())
+			continue
+		}
+		if got, err := os.Readlink(filepath.Join(dst, name)); err != nil || got != target {
+			t.Errorf("%s: link target %q (%v), want %q", name, got, err, target)
+		}
+	}
+	if got := lstat(t, filepath.Join(dst, "etc/rc.conf")).ModTime(); !got.Equal(old) {
+		t.Errorf("etc/rc.conf: mtime %v, want %v", got, old)
+	}
+}
+
+func TestCopyHardLinks(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	tree{files: map[string]os.FileMode{"a": 0644, "other": 0644}}.create(t, src)
+	for _, name := range []string{"b", "c"} {
+		if err := os.Link(filepath.Join(src, "a"), filepath.Join(src, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := copyTree(t, src, dst)
+	// the contents of a linked file are copied once
+	if stats.Files != 2 {
+		t.Errorf("copied %d files, want 2", stats.Files)
+	}
+	a := lstat(t, filepath.Join(dst, "a"))
+	for _, name := range []string{"b", "c"} {
+		if !os.SameFile(a, lstat(t, filepath.Join(dst, name))) {
+			t.Errorf("%s is not a hard link to a", name)
+		}
+	}
+	if os.SameFile(a, lstat(t, filepath.Join(dst, "other"))) {
+		t.Error("other is linked to a")
+	}
+}
+
+func TestCopyResumes(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	files := map[string]os.FileMode{"a": 0644, "b": 0644, "dir/c": 0600}
+	tree{dirs: map[string]os.FileMode{"dir": 0755}, files: files}.create(t, src)
+
+	if stats := copyTree(t, src, dst); stats.Files != 3 || stats.Skipped != 0 {
+		t.Fatalf("first copy: %+v, want 3 files copied", stats)
+	}
+	if stats := copyTree(t, src, dst); stats.Files != 0 || stats.Skipped != 3 {
+		t.Errorf("rerun: %+v, want all 3 files skipped", stats)
+	}
+
+	// same size, different mtime: copied again
+	if err := os.WriteFile(filepath.Join(src, "a"), bytes.ToUpper(content("a")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newer := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "a"), newer, newer); err != nil {
+		t.Fatal(err)
+	}
+	// interrupted copy: a truncated file is copied again
+	if err := os.Truncate(filepath.Join(dst, "dir/c"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if stats := copyTree(t, src, dst); stats.Files != 2 || stats.Skipped != 1 {
+		t.Errorf("rerun after changes: %+v, want 2 files copied and 1 skipped", stats)
+	}
+	got, err := os.ReadFile(filepath.Join(dst, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.ToUpper(content("a"))) {
+		t.Errorf("a was not updated: %q", got)
+	}
+	if got, err := os.ReadFile(filepath.Join(dst, "dir/c")); err != nil || !bytes.Equal(got, content("dir/c")) {
+		t.Errorf("dir/c was not recopied: %q (%v)", got, err)
+	}
+}
@@ -3,10 +3,12 @@ module anylinuxfs/freebsd-bootstrap
 go 1.25.4
 
 require (
+	anylinuxfs/common-go v0.0.0
 	github.com/apex/log v1.4.0
 	github.com/kdomanski/iso9660 v0.4.0
 	github.com/opencontainers/image-spec v1.1.1
 	github.com/opencontainers/umoci v0.4.7
+	github.com/ulikunitz/xz v0.5.15
 	golang.org/x/sys v0.47.0
 )
 
@@ -29,9 +31,12 @@ require (
 	github.com/urfave/cli v1.22.17 // indirect
 	github.com/vbatts/go-mtree v0.5.0 // indirect
 	golang.org/x/crypto v0.54.0 // indirect
+	golang.org/x/time v0.15.0 // indirect
 	google.golang.org/protobuf v1.36.11 // indirect
 )
 
+replace anylinuxfs/common-go => ../common-go
+
 replace github.com/kdomanski/iso9660 => github.com/nohajc/iso9660 v0.0.0-20251105191846-0bf547744ee1
 
 // replace github.com/kdomanski/iso9660 => ../../../3rd-party/iso9660
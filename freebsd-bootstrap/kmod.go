@@ -0,0 +1,252 @@
+package main
+
+import (
+	"anylinuxfs/freebsd-bootstrap/remoteiso"
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Values of mod_metadata.md_type (see sys/module.h).
+const (
+	mdtDepend = 1
+	mdtModule = 2
+)
+
+// sizeof(struct mod_metadata) on 64-bit targets:
+// int md_version, int md_type, const void *md_data, const char *md_cval
+const modMetadataSize = 24
+
+// kernelModuleInfo lists the module names a kernel module provides
+// (DECLARE_MODULE) and the modules it depends on (MODULE_DEPEND).
+type kernelModuleInfo struct {
+	Provides []string
+	Depends  []string
+}
+
+// readKernelModuleInfo parses the set_modmetadata_set linker set of a
+// FreeBSD kernel module. Only modules linked as shared objects (all 64-bit
+// architectures except amd64) are supported.
+func readKernelModuleInfo(path string) (kernelModuleInfo, error) {
+	var info kernelModuleInfo
+
+	f, err := elf.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	if f.Class != elf.ELFCLASS64 || f.Type != elf.ET_DYN {
+		return info, fmt.Errorf("unsupported module format (%v, %v)", f.Class, f.Type)
+	}
+	set := f.Section("set_modmetadata_set")
+	if set == nil {
+		return info, nil
+	}
+
+	m := &moduleImage{f: f}
+	if err := m.loadRelocations(); err != nil {
+		return info, err
+	}
+
+	for off := uint64(0); off+8 <= set.Size; off += 8 {
+		mdAddr, err := m.readPtr(set.Addr + off)
+		if err != nil {
+			return info, err
+		}
+		hdr, err := m.read(mdAddr, modMetadataSize)
+		if err != nil {
+			return info, err
+		}
+		mdType := f.ByteOrder.Uint32(hdr[4:8])
+		if mdType != mdtDepend && mdType != mdtModule {
+			continue
+		}
+		cvalAddr, err := m.readPtr(mdAddr + 16)
+		if err != nil {
+			return info, err
+		}
+		name, err := m.readString(cvalAddr)
+		if err != nil {
+			return info, err
+		}
+		if mdType == mdtModule {
+			info.Provides = append(info.Provides, name)
+		} else {
+			info.Depends = append(info.Depends, name)
+		}
+	}
+	return info, nil
+}
+
+// moduleImage resolves virtual addresses of a shared object to file contents,
+// applying relative relocations to pointers that are filled in at load time.
+type moduleImage struct {
+	f      *elf.File
+	relocs map[uint64]uint64
+}
+
+func (m *moduleImage) loadRelocations() error {
+	m.relocs = make(map[uint64]uint64)
+	syms, _ := m.f.DynamicSymbols()
+
+	for _, s := range m.f.Sections {
+		if s.Type != elf.SHT_RELA {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", s.Name, err)
+		}
+		var rela elf.Rela64
+		r := bytes.NewReader(data)
+		for {
+			err := binary.Read(r, m.f.ByteOrder, &rela)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("read %s: %w", s.Name, err)
+			}
+			symIdx := elf.R_SYM64(rela.Info)
+			switch relocType := elf.R_TYPE64(rela.Info); {
+			case m.f.Machine == elf.EM_AARCH64 && elf.R_AARCH64(relocType) == elf.R_AARCH64_RELATIVE,
+				m.f.Machine == elf.EM_X86_64 && elf.R_X86_64(relocType) == elf.R_X86_64_RELATIVE:
+				m.relocs[rela.Off] = uint64(rela.Addend)
+			case m.f.Machine == elf.EM_AARCH64 && elf.R_AARCH64(relocType) == elf.R_AARCH64_ABS64,
+				m.f.Machine == elf.EM_X86_64 && elf.R_X86_64(relocType) == elf.R_X86_64_64:
+				// symbol indices count the null symbol which DynamicSymbols omits
+				if symIdx > 0 && int(symIdx) <= len(syms) {
+					m.relocs[rela.Off] = syms[symIdx-1].Value + uint64(rela.Addend)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *moduleImage) read(addr uint64, size int) ([]byte, error) {
+	for _, s := range m.f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || addr < s.Addr || addr+uint64(size) > s.Addr+s.Size {
+			continue
+		}
+		buf := make([]byte, size)
+		if s.Type == elf.SHT_NOBITS {
+			return buf, nil
+		}
+		if _, err := s.ReadAt(buf, int64(addr-s.Addr)); err != nil {
+			return nil, fmt.Errorf("read %s at 0x%x: %w", s.Name, addr, err)
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("address 0x%x not mapped by any section", addr)
+}
+
+func (m *moduleImage) readPtr(addr uint64) (uint64, error) {
+	if v, ok := m.relocs[addr]; ok {
+		return v, nil
+	}
+	b, err := m.read(addr, 8)
+	if err != nil {
+		return 0, err
+	}
+	return m.f.ByteOrder.Uint64(b), nil
+}
+
+func (m *moduleImage) readString(addr uint64) (string, error) {
+	var name []byte
+	for len(name) < 256 {
+		b, err := m.read(addr+uint64(len(name)), 1)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(name), nil
+		}
+		name = append(name, b[0])
+	}
+	return "", fmt.Errorf("string at 0x%x is not terminated", addr)
+}
+
+// kernelModules tracks the module names available in the target kernel
+// directory and the dependencies they declare.
+type kernelModules struct {
+	provided  map[string]struct{}
+	required  map[string]struct{}
+	attempted map[string]struct{}
+}
+
+func newKernelModules() *kernelModules {
+	return &kernelModules{
+		provided:  make(map[string]struct{}),
+		required:  make(map[string]struct{}),
+		attempted: make(map[string]struct{}),
+	}
+}
+
+func (k *kernelModules) add(path string) {
+	k.provided[strings.TrimSuffix(filepath.Base(path), ".ko")] = struct{}{}
+
+	info, err := readKernelModuleInfo(path)
+	if err != nil {
+		fmt.Printf("Warning: cannot read module metadata of %s: %v\n", path, err)
+		return
+	}
+	for _, name := range info.Provides {
+		k.provided[name] = struct{}{}
+	}
+	for _, name := range info.Depends {
+		k.required[name] = struct{}{}
+	}
+}
+
+// unresolved returns sorted names of required modules nobody provides.
+func (k *kernelModules) unresolved() []string {
+	var names []string
+	for name := range k.required {
+		if _, ok := k.provided[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// fetchDependencies downloads modules required by the already copied ones
+// from /boot/kernel on the ISO, transitively. Dependencies that cannot be
+// found are reported; they may be built into the kernel.
+func (k *kernelModules) fetchDependencies(ctx context.Context, d *downloader) error {
+	for {
+		var paths []string
+		for _, name := range k.unresolved() {
+			if _, done := k.attempted[name]; done {
+				continue
+			}
+			k.attempted[name] = struct{}{}
+			paths = append(paths, "/boot/kernel/"+name+".ko")
+		}
+		if len(paths) == 0 {
+			break
+		}
+
+		found := remoteiso.FindFiles(d.remoteRoot, paths, d.match)
+		if err := d.downloadWithDependencies(ctx, found); err != nil {
+			return err
+		}
+		for _, entry := range found {
+			fmt.Printf("Fetched kernel module dependency %s\n", entry.Path)
+			k.add(filepath.Join(d.targetDir, entry.Path))
+		}
+	}
+
+	for _, name := range k.unresolved() {
+		fmt.Printf("Warning: kernel module dependency %s not found (it may be built into the kernel)\n", name)
+	}
+	return nil
+}
@@ -1,31 +1,91 @@
 package main
 
 import (
+	"anylinuxfs/common-go/rootfs"
 	"anylinuxfs/freebsd-bootstrap/chroot"
+	"anylinuxfs/freebsd-bootstrap/fscopy"
 	"anylinuxfs/freebsd-bootstrap/mount"
 	"anylinuxfs/freebsd-bootstrap/oci"
 	"anylinuxfs/freebsd-bootstrap/remoteiso"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
 	"debug/elf"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"maps"
-	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/kdomanski/iso9660"
+	"github.com/opencontainers/umoci/oci/layer"
+	"golang.org/x/sys/unix"
 )
 
 type Config struct {
-	IsoUrl string   `json:"iso_url"`
-	Pkgs   []string `json:"pkgs"`
+	IsoUrl     string   `json:"iso_url"`
+	Pkgs       []string `json:"pkgs"`
+	ExtraFiles []string `json:"extra_files"`
+	// ProxyURL takes precedence over HTTPS_PROXY/HTTP_PROXY in the environment
+	ProxyURL string        `json:"proxy_url"`
+	CABundle string        `json:"ca_bundle"`
+	Network  NetworkConfig `json:"network"`
+	// CaseSensitiveISONames disables case-insensitive lookup of RequiredFiles
+	// (only needed if the ISO has names differing just by case)
+	CaseSensitiveISONames bool `json:"case_sensitive_iso_names"`
+	// BlockSize of the ISO read cache, remoteiso.DefaultBlockSize if unset
+	BlockSize int64 `json:"block_size"`
+	// DereferenceSymlinks downloads the target's contents in place of
+	// symlinks pointing to regular files (the targets are still fetched too)
+	DereferenceSymlinks bool `json:"dereference_symlinks"`
+	// PrefetchDirectories loads all directory records of the ISO up front
+	// in a few large requests instead of one request per directory visited
+	PrefetchDirectories bool `json:"prefetch_directories"`
+	// CopyBufferSize and CopyWorkers tune copying the rootfs to the UFS
+	// partition, fscopy defaults if unset
+	CopyBufferSize int `json:"copy_buffer_size"`
+	CopyWorkers    int `json:"copy_workers"`
+	// ISOCacheDir holds decompressed copies of .iso.xz/.iso.gz images. A
+	// compressed image is downloaded in full (instead of just the needed
+	// ranges) and needs disk space for the whole uncompressed ISO, so this
+	// must not point to a tmpfs. It may not be inside workdir and relative
+	// paths are resolved against the directory the bootstrap starts in.
+	ISOCacheDir string `json:"iso_cache_dir"`
+	// MaxDownloadRate caps the ISO download in bytes/sec (unlimited if unset)
+	MaxDownloadRate int64 `json:"max_download_rate"`
+	// Workdir is where the tmpfs holding the temporary root is mounted
+	Workdir string `json:"workdir"`
+	// ImageTag selects the image to unpack from the OCI image disk, the
+	// first tagged one if unset
+	ImageTag string `json:"image_tag"`
+	// TmpfsSize limits the tmpfs (e.g. "2g"; k, m, g and t suffixes are
+	// accepted), the tmpfs default of all available memory if unset
+	TmpfsSize string `json:"tmpfs_size"`
+
+	// rootCAs holds the certificates of CABundle, read by loadConfig since
+	// the file is out of reach once the bootstrap has chrooted
+	rootCAs *x509.CertPool
+	// isoCache is ISOCacheDir opened before the chroot, which would make
+	// the directory unreachable by path
+	isoCache *os.Root
 }
 
+const (
+	defaultISOCacheDir = "iso-cache"
+	defaultWorkdir     = "tmp"
+)
+
 func loadConfig(path string) (Config, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -34,17 +94,130 @@ func loadConfig(path string) (Config, error) {
 	defer f.Close()
 
 	dec := json.NewDecoder(f)
+	// catch misspelled keys (iso_urls instead of iso_url)
+	dec.DisallowUnknownFields()
 	var c Config
 	if err := dec.Decode(&c); err != nil {
 		return Config{}, fmt.Errorf("decode config: %w", err)
 	}
-	if c.IsoUrl == "" {
-		return Config{}, fmt.Errorf("config iso_url is empty")
+	if c.BlockSize == 0 {
+		c.BlockSize = remoteiso.DefaultBlockSize
+	}
+	if c.ISOCacheDir == "" {
+		c.ISOCacheDir = defaultISOCacheDir
+	}
+	if c.Workdir == "" {
+		c.Workdir = defaultWorkdir
+	}
+	if c.ISOCacheDir, err = filepath.Abs(c.ISOCacheDir); err != nil {
+		return Config{}, fmt.Errorf("iso_cache_dir: %w", err)
+	}
+	c.Network.setDefaults()
+	var caErr error
+	if c.CABundle != "" {
+		if c.rootCAs, caErr = remoteiso.LoadCABundle(c.CABundle); caErr != nil {
+			caErr = fmt.Errorf("ca_bundle: %w", caErr)
+		}
+	}
+	if err := errors.Join(c.validate(), caErr); err != nil {
+		return Config{}, fmt.Errorf("invalid config:\n%w", err)
 	}
 	return c, nil
 }
 
-// TODO: include custom files specified by user?
+// validate reports all problems at once (one per line) so that they can be
+// fixed before a long run rather than one run at a time.
+func (c Config) validate() error {
+	var errs []error
+	if c.IsoUrl == "" {
+		errs = append(errs, fmt.Errorf("iso_url is empty"))
+	} else if err := validateURL(c.IsoUrl, "http", "https"); err != nil {
+		errs = append(errs, fmt.Errorf("iso_url: %w", err))
+	}
+	if c.ProxyURL != "" {
+		if err := validateURL(c.ProxyURL); err != nil {
+			errs = append(errs, fmt.Errorf("proxy_url: %w", err))
+		}
+	}
+	for _, pkg := range c.Pkgs {
+		if strings.TrimSpace(pkg) == "" {
+			errs = append(errs, fmt.Errorf("pkgs contains an empty package name"))
+		}
+	}
+	for _, path := range c.ExtraFiles {
+		if !filepath.IsAbs(path) {
+			errs = append(errs, fmt.Errorf("extra_files entry %q is not an absolute path", path))
+		}
+	}
+	if c.BlockSize < 0 {
+		errs = append(errs, fmt.Errorf("block_size must be positive, got %d", c.BlockSize))
+	}
+	if c.CopyBufferSize < 0 {
+		errs = append(errs, fmt.Errorf("copy_buffer_size must not be negative, got %d", c.CopyBufferSize))
+	}
+	if c.MaxDownloadRate < 0 {
+		errs = append(errs, fmt.Errorf("max_download_rate must not be negative, got %d", c.MaxDownloadRate))
+	}
+	if c.CopyWorkers < 0 {
+		errs = append(errs, fmt.Errorf("copy_workers must not be negative, got %d", c.CopyWorkers))
+	}
+	if filepath.Clean(c.Workdir) == "/" {
+		errs = append(errs, fmt.Errorf("workdir must not be the root directory"))
+	}
+	if workdir, err := filepath.Abs(c.Workdir); err == nil && isWithin(c.ISOCacheDir, workdir) {
+		errs = append(errs, fmt.Errorf("iso_cache_dir %s must not be inside workdir (the tmpfs copied to the disk)", c.ISOCacheDir))
+	}
+	if c.TmpfsSize != "" && !validSize(c.TmpfsSize) {
+		errs = append(errs, fmt.Errorf("tmpfs_size %q is not a size like 512m or 2g", c.TmpfsSize))
+	}
+	if err := c.Network.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("network: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// isWithin reports whether path is dir or below it.
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// openISOCache creates and opens the directory for decompressed images.
+func openISOCache(dir string) (*os.Root, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create ISO cache directory: %w", err)
+	}
+	return os.OpenRoot(dir)
+}
+
+// validateURL checks that rawURL is absolute and, if schemes are given, that
+// it uses one of them.
+func validateURL(rawURL string, schemes ...string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", rawURL)
+	}
+	if len(schemes) > 0 && !slices.Contains(schemes, u.Scheme) {
+		return fmt.Errorf("unsupported scheme %q in %q", u.Scheme, rawURL)
+	}
+	return nil
+}
+
+// validSize accepts the sizes FreeBSD's tmpfs understands: a number with an
+// optional k, m, g or t suffix.
+func validSize(size string) bool {
+	digits := strings.TrimRight(size, "kKmMgGtT")
+	if len(size)-len(digits) > 1 || digits == "" {
+		return false
+	}
+	return strings.Trim(digits, "0123456789") == ""
+}
+
+// RequiredFiles lists the files fetched from the ISO (together with their
+// dependencies); extra_files from config.json are appended at runtime.
 var RequiredFiles = []string{
 	"/etc/rc.d/mountd",
 	"/etc/rc.d/nfsd",
@@ -60,6 +233,7 @@ var RequiredFiles = []string{
 	"/usr/bin/ee",
 	"/usr/bin/basename",
 	"/usr/bin/dirname",
+	"/usr/bin/getent",
 	"/usr/bin/ldd",
 	"/usr/bin/rpcinfo",
 	"/usr/bin/sftp",
@@ -76,259 +250,528 @@ var RequiredFiles = []string{
 }
 var LibraryBaseDirs = []string{"/lib", "/usr/lib"}
 
+// Library32BaseDirs hold the compat libraries 32-bit binaries link against
+// on 64-bit FreeBSD (lib32 distribution set).
+var Library32BaseDirs = []string{"/usr/lib32"}
+
 func main() {
+	dryRunFlag := flag.Bool("dry-run", false, "Resolve the files to fetch and print the plan without downloading or touching disks")
+	verbose := flag.Bool("verbose", false, "Print bytes read, HTTP requests and cache hit ratio per phase and per file")
+	progressMode := flag.String("progress", "text", "Progress output: text, or json for newline-delimited JSON events on stdout (all other output goes to stderr)")
+	depsGraph := flag.String("deps-graph", "", "Resolve the dependencies of the required files and write the graph to `file` (JSON if it ends in .json, DOT otherwise)")
+	flag.Parse()
+	dryRun = *dryRunFlag
+
+	switch *progressMode {
+	case "text":
+	case "json":
+		events = newProgressEmitter(os.Stdout)
+		os.Stdout = os.Stderr
+	default:
+		fmt.Printf("Invalid -progress %q: must be text or json\n", *progressMode)
+		os.Exit(1)
+	}
+
 	fmt.Println("Bootstrap started")
 
+	if *depsGraph != "" {
+		config, err := loadConfig("config.json")
+		if err != nil {
+			fmt.Printf("Error: could not load config.json: %v\n", err)
+			os.Exit(1)
+		}
+		if err := runDepsGraph(config, *depsGraph); err != nil {
+			fmt.Printf("Resolving dependencies failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if dryRun {
+		config, err := loadConfig("config.json")
+		if err != nil {
+			fmt.Printf("Error: could not load config.json: %v\n", err)
+			os.Exit(1)
+		}
+		if err := runDryRun(config); err != nil {
+			fmt.Printf("Dry run failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		fmt.Println("Bootstrap must run as root (mount and chroot require it)")
+		os.Exit(1)
+	}
+
 	// Load ISO URL from config.json before performing operations
 	config, err := loadConfig("config.json")
 	freebsdISO := config.IsoUrl
 	if err != nil {
-		fmt.Printf("Warning: could not load config.json (%v).\n", err)
-		return
+		fmt.Printf("Warning: could not load config.json: %v\n", err)
+		os.Exit(1)
 	}
 
-	workdir := "tmp"
+	workdir := config.Workdir
 	if _, err := os.Stat(workdir); os.IsNotExist(err) {
 		err := os.Mkdir(workdir, 0755)
 		if err != nil {
 			fmt.Printf("Failed to create workdir %s: %v\n", workdir, err)
-			return
+			os.Exit(1)
 		}
 	}
-	err = mount.Mount("tmpfs", workdir, "tmpfs", "")
+	var tmpfsOptions string
+	if config.TmpfsSize != "" {
+		tmpfsOptions = "size=" + config.TmpfsSize
+	}
+	err = mount.Mount("tmpfs", workdir, "tmpfs", tmpfsOptions)
 	if err != nil {
 		fmt.Printf("Failed to mount tmpfs on %s: %v\n", workdir, err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("mounted tmpfs")
 
 	err = copyInitBinary(workdir)
 	if err != nil {
 		fmt.Printf("Failed to copy init binary: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
 	err = copyVmproxyBinary(workdir)
 	if err != nil {
 		fmt.Printf("Failed to copy VM proxy binary: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
 	err = copyNFSLauncher(workdir)
 	if err != nil {
 		fmt.Printf("Failed to copy NFS launcher: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
 	kernelDir := filepath.Join(workdir, "boot", "kernel")
 	err = os.MkdirAll(kernelDir, 0755)
 	if err != nil {
 		fmt.Printf("Failed to create kernel directory %s: %v\n", kernelDir, err)
-		return
+		os.Exit(1)
 	}
-	err = copyKernelModules(kernelDir)
+	kmods, err := copyKernelModules(kernelDir)
 	if err != nil {
 		fmt.Printf("%v\n", err)
-		return
+		os.Exit(1)
+	}
+
+	config.isoCache, err = openISOCache(config.ISOCacheDir)
+	if err != nil {
+		fmt.Printf("Failed to open ISO cache %s: %v\n", config.ISOCacheDir, err)
+		os.Exit(1)
 	}
 
 	// Switch to a temporary root populated from the ISO
 	err = os.Chdir(workdir)
 	if err != nil {
 		fmt.Printf("Failed to change directory to %s: %v\n", workdir, err)
-		return
+		os.Exit(1)
 	}
 	err = chroot.Chroot(".")
 	if err != nil {
 		fmt.Printf("Failed to chroot into current directory: %v\n", err)
-		return
+		os.Exit(1)
 	}
+	fmt.Printf("chrooted to %s\n", workdir)
 	workdir = "/"
 
-	fmt.Println("chrooted to /tmp")
-
 	err = os.Mkdir("/dev", 0755)
 	if err != nil && !os.IsExist(err) {
 		fmt.Printf("Failed to create /dev directory: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	err = mount.Mount("devfs", "/dev", "devfs", "")
 	if err != nil {
 		fmt.Printf("Failed to mount devfs on /dev: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("mounted devfs")
 
 	err = os.MkdirAll("/mnt/img", 0755)
 	if err != nil && !os.IsExist(err) {
 		fmt.Printf("Error creating /mnt/img: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
 	ociDir := "/mnt/img"
-	err = mount.Mount("/dev/vtbd2", ociDir, "cd9660", "")
+	err = mountWhenReady("/dev/vtbd2", ociDir, "cd9660", deviceWaitTimeout)
 	if err != nil {
-		fmt.Printf("Error mounting /dev/vtbd2 to %s: %v\n", ociDir, err)
-		return
+		fmt.Printf("Error mounting the OCI image disk: %v\n", err)
+		os.Exit(1)
+	}
+	if err := oci.CheckLayout(ociDir); err != nil {
+		fmt.Printf("Error: /dev/vtbd2 does not contain the OCI image: %v\n", err)
+		os.Exit(1)
 	}
 	fmt.Println("mounted OCI image")
 
-	err = oci.Unpack(ociDir, ".")
+	err = oci.Unpack(ociDir, config.ImageTag, ".", rootfs.UnpackOptions(layer.MapOptions{}))
 	if err != nil {
 		fmt.Printf("Error unpacking OCI image: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("unpacked OCI image")
 
-	err = initNetwork()
+	err = initNetwork(config.Network)
 	if err != nil {
 		fmt.Printf("Error initializing network: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("network initialized")
 
-	err = createResolvConf("/")
+	err = createResolvConf(config.Network, "/")
 	if err != nil {
 		fmt.Printf("Error creating resolv.conf: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("created resolv.conf")
 
 	err = createFstab("/")
 	if err != nil {
 		fmt.Printf("Error creating fstab: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("created fstab")
 
 	err = editGettytab("/")
 	if err != nil {
 		fmt.Printf("Error editing gettytab: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("edited gettytab")
 
 	err = createScripts(config, "/")
 	if err != nil {
 		fmt.Printf("Error creating scripts: %v\n", err)
-		return
+		os.Exit(1)
 	}
 	fmt.Println("created scripts")
 
 	err = createAdditionalDirs()
 	if err != nil {
 		fmt.Printf("Error creating additional directories: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
-	reader := &remoteiso.HTTPReaderAt{
-		URL: freebsdISO,
-		Client: &http.Client{
-			Timeout: 5 * time.Second,
-		},
+	// Ctrl-C or SIGTERM aborts in-flight range requests
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	root, cache, err := openISO(ctx, config)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
 	}
 
-	cached := &remoteiso.CachedReaderAt{
-		Base:      reader,
-		BlockSize: 128 * 1024,
-		Cache:     make(map[int64][]byte),
+	fmt.Printf("Reading %s:\n", freebsdISO)
+
+	start := time.Now()
+	// listDir(root, "")
+
+	requiredFiles := slices.Concat(RequiredFiles, config.ExtraFiles)
+	match := remoteiso.MatchOptions{CaseSensitive: config.CaseSensitiveISONames}
+	foundFiles := remoteiso.FindFiles(root, requiredFiles, match)
+	warnMissingFiles(root, config, foundFiles, match)
+	events.phase("download")
+	downloadSize, err := checkWorkdirSpace(ctx, workdir, root, foundFiles, match)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		events.fail("download", err)
+		os.Exit(1)
+	}
+	d := newDownloader(workdir, root, match)
+	d.expectedBytes = downloadSize
+	d.dereference = config.DereferenceSymlinks
+	if *verbose {
+		d.acct = newAccounting(cache)
+	}
+	d.phase = "required files"
+	err = d.downloadWithDependencies(ctx, foundFiles)
+	if err == nil {
+		d.phase = "kernel modules"
+		err = kmods.fetchDependencies(ctx, d)
 	}
+	if err != nil {
+		fmt.Printf("Download interrupted: %v\n", err)
+		events.fail("download", err)
+		os.Exit(1)
+	}
+
+	duration := time.Since(start)
 
-	image, err := iso9660.OpenImage(cached)
+	d.acct.print()
+	fmt.Printf("\nTotal bytes read via HTTP: %d in %d requests\n", remoteiso.TotalBytesRead.Load(), remoteiso.TotalRequests.Load())
+	cacheStats := cache.Stats()
+	fmt.Printf("ISO cache: %.1f%% hit ratio (%d hits, %d misses), %d bytes served, %d bytes fetched\n",
+		cacheStats.HitRatio()*100, cacheStats.Hits, cacheStats.Misses, cacheStats.BytesServed, cacheStats.BytesFetched)
+	fmt.Printf("Duration: %v\n", duration)
+
+	events.phase("partition")
+	err = partitionDisk("vtbd1")
 	if err != nil {
-		fmt.Printf("Failed to open ISO image %s: %v\n", freebsdISO, err)
-		return
+		fmt.Printf("Error partitioning vtbd1: %v\n", err)
+		events.fail("partition", err)
+		os.Exit(1)
 	}
 
-	root, err := image.RootDir()
+	events.phase("copy")
+	err = os.MkdirAll("/mnt/ufs", 0755)
+	if err != nil && !os.IsExist(err) {
+		fmt.Printf("Error creating /mnt/ufs: %v\n", err)
+		events.fail("copy", err)
+		os.Exit(1)
+	}
+
+	err = mount.Mount("/dev/vtbd1p1", "/mnt/ufs", "ufs", "")
 	if err != nil {
-		fmt.Printf("Failed to get root directory of ISO: %v\n", err)
-		return
+		fmt.Printf("Error mounting /dev/vtbd1p1 to /mnt/ufs: %v\n", err)
+		events.fail("copy", err)
+		os.Exit(1)
 	}
 
-	fmt.Printf("Reading %s:\n", freebsdISO)
+	copyOptions := fscopy.Options{
+		BufferSize:       config.CopyBufferSize,
+		Workers:          config.CopyWorkers,
+		ProgressInterval: 5 * time.Second,
+	}
+	if events != nil {
+		copyOptions.Progress = func(s fscopy.Stats) {
+			events.emit(progressEvent{Phase: "copy", Files: s.Files, Bytes: s.Bytes})
+		}
+	}
+	stats, err := fscopy.Copy("/", "/mnt/ufs", copyOptions)
+	if err != nil {
+		fmt.Printf("Error copying files to /mnt/ufs: %v\n", err)
+		events.fail("copy", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Copied %d files (%d bytes), %d already up to date\n", stats.Files, stats.Bytes, stats.Skipped)
+	events.emit(progressEvent{Phase: "copy", Files: stats.Files, Bytes: stats.Bytes, Percent: 100})
 
-	start := time.Now()
-	// listDir(root, "")
+	err = mount.Unmount("/mnt/ufs")
+	if err != nil {
+		fmt.Printf("Error unmounting /mnt/ufs: %v\n", err)
+		events.fail("copy", err)
+		os.Exit(1)
+	}
+	fmt.Println("Bootstrap completed successfully")
+	events.phase("done")
+}
 
-	foundFiles := remoteiso.FindFiles(root, RequiredFiles)
-	d := newDownloader(workdir, root)
-	d.downloadWithDependencies(foundFiles)
+const (
+	// deviceWaitTimeout bounds waiting for disks that are probed late
+	deviceWaitTimeout  = 30 * time.Second
+	deviceWaitInterval = 250 * time.Millisecond
+)
 
-	duration := time.Since(start)
+// mountWhenReady waits for device to appear and mounts it, retrying until
+// timeout since the disk may show up before its media can be read.
+func mountWhenReady(device, target, fsType string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := os.Stat(device)
+		present := err == nil
+		if present {
+			err = mount.Mount(device, target, fsType, "")
+			if err == nil {
+				return nil
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			if !present {
+				return fmt.Errorf("device %s did not appear within %v", device, timeout)
+			}
+			return fmt.Errorf("mount %s on %s: %w", device, target, err)
+		}
+		time.Sleep(deviceWaitInterval)
+	}
+}
 
-	fmt.Printf("\nTotal bytes read via HTTP: %d\n", remoteiso.TotalBytesRead)
-	fmt.Printf("Duration: %v\n", duration)
+// openISO opens the remote FreeBSD ISO and returns its root directory and
+// the block cache in front of it.
+func openISO(ctx context.Context, config Config) (*iso9660.File, *remoteiso.CachedReaderAt, error) {
+	client, err := remoteiso.NewHTTPClient(remoteiso.ClientOptions{
+		Timeout:        5 * time.Second,
+		ProxyURL:       config.ProxyURL,
+		RootCAs:        config.rootCAs,
+		MaxBytesPerSec: config.MaxDownloadRate,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to set up HTTP client: %w", err)
+	}
 
-	err = run("/sbin/gpart", "show")
+	reader := &remoteiso.HTTPReaderAt{
+		URL:     config.IsoUrl,
+		Client:  client,
+		Context: ctx,
+	}
+
+	cached, err := remoteiso.NewCachedReaderAt(reader, config.BlockSize)
 	if err != nil {
-		fmt.Printf("Error executing /sbin/gpart: %v\n", err)
-		return
+		return nil, nil, fmt.Errorf("failed to set up ISO reader: %w", err)
 	}
 
-	err = run("/sbin/gpart", "create", "-s", "gpt", "vtbd1")
+	var source io.ReaderAt = cached
+	if comp := remoteiso.DetectCompression(cached, config.IsoUrl); comp != remoteiso.Uncompressed {
+		fmt.Printf("%s is %s compressed, downloading it to %s\n", config.IsoUrl, comp, config.ISOCacheDir)
+		cache := config.isoCache
+		if cache == nil {
+			if cache, err = openISOCache(config.ISOCacheDir); err != nil {
+				return nil, nil, err
+			}
+			defer cache.Close()
+		}
+		f, err := remoteiso.DecompressToCache(ctx, client, config.IsoUrl, comp, cache)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decompress ISO image: %w", err)
+		}
+		source = f
+	} else if config.PrefetchDirectories {
+		requests := remoteiso.TotalRequests.Load()
+		n, err := cached.PrefetchDirectories()
+		if err != nil {
+			// lookups still work, just with more requests
+			fmt.Printf("Warning: could not prefetch ISO directories: %v\n", err)
+		} else {
+			fmt.Printf("Prefetched %d directories in %d requests\n", n, remoteiso.TotalRequests.Load()-requests)
+		}
+	}
+
+	image, err := iso9660.OpenImage(source)
 	if err != nil {
-		fmt.Printf("Error creating GPT partition scheme: %v\n", err)
+		return nil, nil, fmt.Errorf("failed to open ISO image %s: %w", config.IsoUrl, err)
 	}
 
-	err = run("/sbin/gpart", "add", "-t", "freebsd-ufs", "-l", "rootfs", "vtbd1")
+	root, err := image.RootDir()
 	if err != nil {
-		fmt.Printf("Error adding freebsd-ufs partition: %v\n", err)
+		return nil, nil, fmt.Errorf("failed to get root directory of ISO: %w", err)
 	}
+	return root, cached, nil
+}
 
-	err = run("/sbin/newfs", "-U", "/dev/vtbd1p1")
+// partitionDisk creates a GPT scheme with a single UFS partition labeled
+// rootfs on disk and formats it. A partially created scheme left behind by
+// a failed attempt is destroyed before retrying once.
+func partitionDisk(disk string) error {
+	err := run("/sbin/gpart", "show")
 	if err != nil {
-		fmt.Printf("Error creating filesystem: %v\n", err)
-		return
+		return fmt.Errorf("gpart show: %w", err)
 	}
 
-	err = os.MkdirAll("/mnt/ufs", 0755)
-	if err != nil && !os.IsExist(err) {
-		fmt.Printf("Error creating /mnt/ufs: %v\n", err)
-		return
+	err = createPartitions(disk)
+	if err != nil {
+		fmt.Printf("Partitioning %s failed (%v), destroying partition scheme and retrying\n", disk, err)
+		destroyPartitions(disk)
+
+		err = createPartitions(disk)
+		if err != nil {
+			destroyPartitions(disk)
+			return err
+		}
 	}
 
-	err = mount.Mount("/dev/vtbd1p1", "/mnt/ufs", "ufs", "")
+	err = run("/sbin/newfs", "-U", "/dev/"+disk+"p1")
 	if err != nil {
-		fmt.Printf("Error mounting /dev/vtbd1p1 to /mnt/ufs: %v\n", err)
+		return fmt.Errorf("creating filesystem: %w", err)
 	}
+	return nil
+}
 
-	err = run("/bin/cp", "-avx", "/", "/mnt/ufs")
+func createPartitions(disk string) error {
+	err := run("/sbin/gpart", "create", "-s", "gpt", disk)
 	if err != nil {
-		fmt.Printf("Error copying files to /mnt/ufs: %v\n", err)
-		return
+		return fmt.Errorf("creating GPT partition scheme: %w", err)
 	}
 
-	err = run("/sbin/umount", "/mnt/ufs")
+	err = run("/sbin/gpart", "add", "-t", "freebsd-ufs", "-l", "rootfs", disk)
 	if err != nil {
-		fmt.Printf("Error unmounting /mnt/ufs: %v\n", err)
+		return fmt.Errorf("adding freebsd-ufs partition: %w", err)
 	}
-	fmt.Println("Bootstrap completed successfully")
+	return nil
 }
 
-func run(command string, args ...string) error {
-	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func destroyPartitions(disk string) {
+	err := run("/sbin/gpart", "destroy", "-F", disk)
+	if err != nil {
+		// nothing to destroy if the scheme was never created
+		fmt.Printf("Could not destroy partition scheme on %s: %v\n", disk, err)
+	}
+}
+
+// warnMissingFiles reports the required and extra files which were not
+// found in the ISO. When the parent directory is missing as well (files
+// relocated in a new FreeBSD release), the directory is reported instead.
+func warnMissingFiles(root *iso9660.File, config Config, found []*remoteiso.FileEntry, match remoteiso.MatchOptions) {
+	check := func(kind string, files []string) {
+		for _, p := range files {
+			if slices.ContainsFunc(found, func(e *remoteiso.FileEntry) bool { return e.Path == p }) {
+				continue
+			}
+			dir := path.Dir(p)
+			dirs := remoteiso.FindFiles(root, []string{dir}, match)
+			if len(dirs) == 0 || !dirs[0].File.IsDir() {
+				fmt.Printf("Warning: directory %s not found in ISO (needed for %s file %s)\n", dir, kind, p)
+				continue
+			}
+			fmt.Printf("Warning: %s file %s not found in ISO\n", kind, p)
+		}
+	}
+	check("required", RequiredFiles)
+	check("extra", config.ExtraFiles)
 }
 
 type downloader struct {
 	targetDir     string
 	remoteRoot    *iso9660.File
+	match         remoteiso.MatchOptions
 	finishedFiles map[string]struct{}
+	// attempted guarantees termination: every path is tried at most once
+	attempted map[string]struct{}
+	// links maps downloaded symlinks to their resolved ISO targets
+	links map[string]string
+	// plan collects the files instead of downloading them (dry run)
+	plan *[]*remoteiso.FileEntry
+	// dereference copies the targets of symlinks instead of recreating
+	// the links (see Config.DereferenceSymlinks)
+	dereference bool
+	// graph records the resolved dependencies (-deps-graph)
+	graph *depGraph
+	// acct records ISO reads per file (-verbose), labeled with phase or,
+	// for files pulled in as dependencies, "<phase> dependencies"
+	acct  *accounting
+	phase string
+	depth int
+	// expectedBytes (estimated) and downloadedBytes give the download
+	// percentage of -progress json
+	expectedBytes   int64
+	downloadedBytes int64
 }
 
-func newDownloader(targetDir string, remoteRoot *iso9660.File) *downloader {
+func newDownloader(targetDir string, remoteRoot *iso9660.File, match remoteiso.MatchOptions) *downloader {
 	return &downloader{
 		targetDir:     targetDir,
 		remoteRoot:    remoteRoot,
+		match:         match,
 		finishedFiles: make(map[string]struct{}),
+		attempted:     make(map[string]struct{}),
+		links:         make(map[string]string),
 	}
 }
 
-func (d *downloader) downloadWithDependencies(remoteFiles []*remoteiso.FileEntry) {
-	libraryDeps := map[string]struct{}{}
+// downloadWithDependencies downloads the files and, recursively, the shared
+// libraries and interpreters they need. It only fails if ctx is cancelled;
+// other errors are reported and the file is skipped.
+func (d *downloader) downloadWithDependencies(ctx context.Context, remoteFiles []*remoteiso.FileEntry) error {
+	libraryPaths := map[string]struct{}{}
 	pathDeps := map[string]struct{}{}
 	for _, entry := range remoteFiles {
 		// fmt.Printf(" - %s (size: %d bytes)\n", entry.Path, entry.File.Size())
@@ -336,68 +779,249 @@ func (d *downloader) downloadWithDependencies(remoteFiles []*remoteiso.FileEntry
 			fmt.Printf("Skipping already downloaded %s\n", entry.Path)
 			continue
 		}
-		localPath, err := entry.Download(d.targetDir)
+		if _, tried := d.attempted[path.Clean(entry.Path)]; tried {
+			continue
+		}
+		d.attempted[path.Clean(entry.Path)] = struct{}{}
+		d.graph.addFound(entry.Path)
+
+		var localPath string
+		var err error
+		if d.plan != nil {
+			*d.plan = append(*d.plan, entry)
+		} else {
+			if d.dereference {
+				entry = d.withSymlinkTarget(entry)
+			}
+			before := d.acct.snapshot()
+			localPath, err = entry.Download(ctx, d.targetDir)
+			d.acct.record(d.phaseName(), entry, d.acct.snapshot().sub(before))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			fmt.Printf("Error downloading %s: %v\n", entry.Path, err)
+			events.emit(progressEvent{Phase: "download", File: entry.Path, Error: err.Error()})
 			continue
 		}
 		d.finishedFiles[entry.Path] = struct{}{}
+		if d.plan == nil {
+			d.downloadedBytes += entry.File.Size()
+			events.emit(progressEvent{
+				Phase:   "download",
+				File:    entry.Path,
+				Bytes:   entry.File.Size(),
+				Percent: percent(d.downloadedBytes, d.expectedBytes),
+			})
+		}
 
-		deps := getDependencies(localPath)
-		for _, d := range deps {
-			if strings.HasPrefix(d, "/") {
-				pathDeps[d] = struct{}{}
+		if entry.File.Mode()&os.ModeSymlink != 0 {
+			// follow the link on the ISO side; chains are resolved one
+			// level per recursion
+			target, err := d.addSymlink(entry.Path, entry.File.SymlinkTarget())
+			d.graph.addEdge(entry.Path, target)
+			if err != nil {
+				fmt.Printf("Error following %s: %v\n", entry.Path, err)
+				events.emit(progressEvent{Phase: "download", File: entry.Path, Error: err.Error()})
+			} else if _, done := d.finishedFiles[target]; done {
+				fmt.Printf("Skipping %s, target of %s, already downloaded\n", target, entry.Path)
 			} else {
-				libraryDeps[d] = struct{}{}
+				pathDeps[target] = struct{}{}
 			}
+			continue
 		}
-	}
 
-	possiblePaths := []string{}
-	for prefix := range LibraryBaseDirs {
-		for lib := range libraryDeps {
-			possiblePaths = append(possiblePaths, filepath.Join(LibraryBaseDirs[prefix], lib))
+		var deps, libDirs []string
+		if d.plan != nil {
+			deps, libDirs = getRemoteDependencies(entry)
+		} else {
+			deps, libDirs = getDependencies(localPath)
+		}
+		for _, dep := range deps {
+			if strings.HasPrefix(dep, "/") {
+				pathDeps[dep] = struct{}{}
+				d.graph.addEdge(entry.Path, dep)
+				continue
+			}
+			d.graph.addLibrary(entry.Path, dep)
+			for _, dir := range libDirs {
+				libraryPaths[filepath.Join(dir, dep)] = struct{}{}
+			}
 		}
 	}
+
+	possiblePaths := slices.Collect(maps.Keys(libraryPaths))
 	possiblePaths = append(possiblePaths, slices.Collect(maps.Keys(pathDeps))...)
 
-	foundLibraries := remoteiso.FindFiles(d.remoteRoot, possiblePaths)
+	foundLibraries := remoteiso.FindFiles(d.remoteRoot, possiblePaths, d.match)
+	for _, entry := range foundLibraries {
+		if _, ok := libraryPaths[entry.Path]; ok {
+			d.graph.addEdge(path.Base(entry.Path), entry.Path)
+		}
+	}
 	if len(foundLibraries) > 0 {
-		d.downloadWithDependencies(foundLibraries)
+		d.depth++
+		defer func() { d.depth-- }()
+		return d.downloadWithDependencies(ctx, foundLibraries)
 	}
+	return nil
 }
 
-func getDependencies(filePath string) []string {
-	// Check if the file is a symlink and return its target if so
-	fileInfo, err := os.Lstat(filePath)
-	if err != nil {
-		return nil
+// checkWorkdirSpace resolves the files to download (reading just the ELF
+// headers, which the ISO cache keeps for the download itself) and fails if
+// they won't fit into the free space of the tmpfs at dir. Kernel module
+// dependencies are not included in the returned estimate of the download
+// size.
+func checkWorkdirSpace(ctx context.Context, dir string, root *iso9660.File, files []*remoteiso.FileEntry, match remoteiso.MatchOptions) (int64, error) {
+	var plan []*remoteiso.FileEntry
+	d := newDownloader("", root, match)
+	d.plan = &plan
+	if err := d.downloadWithDependencies(ctx, files); err != nil {
+		return 0, err
+	}
+	var needed int64
+	for _, entry := range plan {
+		if entry.File.Mode()&os.ModeSymlink == 0 {
+			needed += entry.File.Size()
+		}
 	}
-	if fileInfo.Mode()&os.ModeSymlink != 0 {
-		target, err := os.Readlink(filePath)
-		if err != nil {
-			fmt.Printf("   Cannot resolve symlink %s: %v\n", filePath, err)
+
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %w", dir, err)
+	}
+	free := st.Bavail * int64(st.Bsize)
+	if needed > free {
+		return 0, fmt.Errorf("tmpfs too small: the files to download need about %d MiB, only %d MiB are free (raise tmpfs_size in config.json)", needed>>20, free>>20)
+	}
+	return needed, nil
+}
+
+// withSymlinkTarget returns entry with Target set if it is a symlink to a
+// regular file on the ISO. Chains of links are not followed.
+func (d *downloader) withSymlinkTarget(entry *remoteiso.FileEntry) *remoteiso.FileEntry {
+	if entry.File.Mode()&os.ModeSymlink == 0 {
+		return entry
+	}
+	target := resolveSymlinkTarget(entry.Path, entry.File.SymlinkTarget())
+	found := remoteiso.FindFiles(d.remoteRoot, []string{target}, d.match)
+	if len(found) == 0 || !found[0].File.Mode().IsRegular() {
+		return entry
+	}
+	return &remoteiso.FileEntry{File: entry.File, Path: entry.Path, Target: found[0].File}
+}
+
+func (d *downloader) phaseName() string {
+	if d.depth == 0 {
+		return d.phase
+	}
+	return d.phase + " dependencies"
+}
+
+var errSymlinkCycle = errors.New("symlink cycle")
+
+// addSymlink records the link at linkPath and returns the ISO path it
+// resolves to. It fails with errSymlinkCycle if following the known links
+// leads back to linkPath, so a cycle is reported instead of followed.
+func (d *downloader) addSymlink(linkPath, target string) (string, error) {
+	resolved := resolveSymlinkTarget(linkPath, target)
+	d.links[path.Clean(linkPath)] = resolved
+	if cycle := d.symlinkCycle(linkPath); cycle != nil {
+		return resolved, fmt.Errorf("%w: %s", errSymlinkCycle, strings.Join(cycle, " -> "))
+	}
+	return resolved, nil
+}
+
+// symlinkCycle returns the chain of links starting at start if following
+// the already known links leads back to a path in the chain.
+func (d *downloader) symlinkCycle(start string) []string {
+	chain := []string{path.Clean(start)}
+	for {
+		next, ok := d.links[chain[len(chain)-1]]
+		if !ok {
 			return nil
 		}
-		if !strings.HasPrefix(target, "/") {
-			target = filepath.Clean(filepath.Join(filepath.Dir(filePath), target))
+		if slices.Contains(chain, next) {
+			return append(chain, next)
 		}
-		// fmt.Printf("   Adding dependency: %s\n", target)
-		return []string{target}
+		chain = append(chain, next)
+	}
+}
+
+// resolveSymlinkTarget returns the absolute ISO path a symlink at linkPath
+// pointing to target refers to.
+func resolveSymlinkTarget(linkPath, target string) string {
+	if !strings.HasPrefix(target, "/") {
+		target = path.Join(path.Dir(linkPath), target)
 	}
+	return path.Clean(target)
+}
+
+// getDependencies returns the shared libraries an ELF file needs and the
+// directories to look for them in, which depend on the ELF class.
+func getDependencies(filePath string) (libs []string, libDirs []string) {
 	f, err := elf.Open(filePath)
 	if err != nil {
 		var fmtErr *elf.FormatError
 		if !errors.As(err, &fmtErr) {
 			fmt.Printf("   Cannot scan file %s for dependencies: %v\n", filePath, err)
 		}
-		return nil
+		return nil, nil
 	}
 	defer f.Close()
+	return elfDependencies(f, filePath)
+}
+
+// getRemoteDependencies is getDependencies reading the ELF headers
+// directly from the ISO.
+func getRemoteDependencies(entry *remoteiso.FileEntry) (libs []string, libDirs []string) {
+	ra, ok := entry.File.Reader().(io.ReaderAt)
+	if !ok {
+		return nil, nil
+	}
+	f, err := elf.NewFile(ra)
+	if err != nil {
+		return nil, nil
+	}
+	return elfDependencies(f, entry.Path)
+}
+
+func elfDependencies(f *elf.File, name string) (libs []string, libDirs []string) {
+	libs, _ = f.ImportedLibraries()
+	fmt.Printf("   %s: %v %v %v\n", name, f.Class, f.Data, f.Machine)
+	if err := checkELFMachine(f, name); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
 
-	libs, _ := f.ImportedLibraries()
+	if f.Class == elf.ELFCLASS32 {
+		return libs, Library32BaseDirs
+	}
+	return libs, LibraryBaseDirs
+}
 
-	return libs
+// checkELFMachine reports binaries which can't run in the arm64 VM. 32-bit
+// arm binaries (the lib32 compat libraries) are fine.
+func checkELFMachine(f *elf.File, name string) error {
+	want := elf.EM_AARCH64
+	if f.Class == elf.ELFCLASS32 {
+		want = elf.EM_ARM
+	}
+	if f.Machine != want {
+		return fmt.Errorf("%s is built for %v, the VM needs %v", name, f.Machine, want)
+	}
+	return nil
+}
+
+// checkELFExecutable makes sure one of our own binaries shipped with the
+// bootstrap was built for the VM.
+func checkELFExecutable(path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s is not an ELF executable: %w", path, err)
+	}
+	defer f.Close()
+	return checkELFMachine(f, path)
 }
 
 func copyFile(srcPath, dstPath string) error {
@@ -418,31 +1042,83 @@ func copyFile(srcPath, dstPath string) error {
 		return fmt.Errorf("failed to get source file info: %w", err)
 	}
 
-	_, err = srcFile.WriteTo(dstFile)
+	n, err := srcFile.WriteTo(dstFile)
 	if err != nil {
 		return fmt.Errorf("failed to copy file content: %w", err)
 	}
+	if n != srcInfo.Size() {
+		return fmt.Errorf("short copy of %s: wrote %d of %d bytes", srcPath, n, srcInfo.Size())
+	}
 
 	err = dstFile.Chmod(srcInfo.Mode())
 	if err != nil {
 		return fmt.Errorf("failed to set file permissions: %w", err)
 	}
 
+	// errors from delayed writes (e.g. a full disk) may only surface on close
+	err = dstFile.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close destination file %s: %w", dstPath, err)
+	}
+
 	fmt.Printf("Copied %s to %s\n", srcPath, dstPath)
 	return nil
 }
 
+// copyFileVerified copies srcPath to dstPath like copyFile and then compares
+// SHA-256 checksums of both files to make sure the copy is intact.
+func copyFileVerified(srcPath, dstPath string) error {
+	err := copyFile(srcPath, dstPath)
+	if err != nil {
+		return err
+	}
+
+	srcSum, err := fileChecksum(srcPath)
+	if err != nil {
+		return err
+	}
+	dstSum, err := fileChecksum(dstPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return fmt.Errorf("checksum mismatch after copying %s to %s", srcPath, dstPath)
+	}
+	return nil
+}
+
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
 func copyInitBinary(targetDir string) error {
 	srcPath := "/init-freebsd"
 	dstPath := filepath.Join(targetDir, "init-freebsd")
 
-	return copyFile(srcPath, dstPath)
+	if err := checkELFExecutable(srcPath); err != nil {
+		return err
+	}
+	return copyFileVerified(srcPath, dstPath)
 }
 
 func copyVmproxyBinary(targetDir string) error {
 	srcPath := "/vmproxy-bsd"
 	dstPath := filepath.Join(targetDir, "vmproxy-bsd")
 
+	if err := checkELFExecutable(srcPath); err != nil {
+		return err
+	}
 	return copyFile(srcPath, dstPath)
 }
 
@@ -458,30 +1134,33 @@ func copyNFSLauncher(targetDir string) error {
 	return copyFile(srcPath, dstFile)
 }
 
-func copyKernelModules(targetDir string) error {
+func copyKernelModules(targetDir string) (*kernelModules, error) {
 	files, err := filepath.Glob("/*.ko")
 	if err != nil {
-		return fmt.Errorf("invalid glob pattern: %w", err)
+		return nil, fmt.Errorf("invalid glob pattern: %w", err)
 	}
 
+	kmods := newKernelModules()
 	for _, srcPath := range files {
 		dstPath := filepath.Join(targetDir, filepath.Base(srcPath))
 
-		err := copyFile(srcPath, dstPath)
+		err := copyFileVerified(srcPath, dstPath)
 		if err != nil {
-			return fmt.Errorf("Failed to copy kernel module %s: %w", srcPath, err)
+			return nil, fmt.Errorf("Failed to copy kernel module %s: %w", srcPath, err)
 		}
+		kmods.add(dstPath)
 	}
-	return nil
+	fmt.Printf("Copied %d kernel modules\n", len(files))
+	return kmods, nil
 }
 
-func initNetwork() error {
-	err := run("/sbin/ifconfig", "vtnet0", "inet", "192.168.127.2/24")
+func initNetwork(network NetworkConfig) error {
+	err := run("/sbin/ifconfig", "vtnet0", "inet", network.GuestAddr)
 	if err != nil {
 		return fmt.Errorf("failed to configure network interface: %w", err)
 	}
 
-	err = run("/sbin/route", "add", "default", "192.168.127.1")
+	err = run("/sbin/route", "add", "default", network.Gateway)
 	if err != nil {
 		return fmt.Errorf("failed to add default route: %w", err)
 	}
@@ -489,15 +1168,14 @@ func initNetwork() error {
 	return nil
 }
 
-func createResolvConf(targetDir string) error {
+func createResolvConf(network NetworkConfig, targetDir string) error {
 	resolvPath := filepath.Join(targetDir, "etc", "resolv.conf")
 	err := os.MkdirAll(filepath.Dir(resolvPath), 0755)
 	if err != nil {
 		return fmt.Errorf("failed to create etc directory: %w", err)
 	}
 
-	content := "nameserver 192.168.127.1\n"
-	err = os.WriteFile(resolvPath, []byte(content), 0644)
+	err = os.WriteFile(resolvPath, []byte(network.resolvConf()), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write resolv.conf: %w", err)
 	}
@@ -537,11 +1215,13 @@ func editGettytab(baseDir string) error {
 	return nil
 }
 
-const InitNetworkScript = `#!/bin/sh
+func initNetworkScript(network NetworkConfig) string {
+	return fmt.Sprintf(`#!/bin/sh
 
-ifconfig vtnet0 inet 192.168.127.2/24
-route add default 192.168.127.1
-`
+ifconfig vtnet0 inet %s
+route add default %s
+`, network.GuestAddr, network.Gateway)
+}
 
 // const StartShellScript = `#!/bin/sh
 
@@ -569,13 +1249,14 @@ umount $MOUNT_POINT
 `
 
 var AllScripts = map[string]string{
-	"init-network.sh":     InitNetworkScript,
 	"start-shell.sh":      StartShellScript,
 	"upgrade-binaries.sh": UpgradeBinariesScript,
 }
 
 func createScripts(config Config, targetDir string) error {
-	for name, content := range AllScripts {
+	scripts := maps.Clone(AllScripts)
+	scripts["init-network.sh"] = initNetworkScript(config.Network)
+	for name, content := range scripts {
 		scriptPath := filepath.Join(targetDir, name)
 		err := os.WriteFile(scriptPath, []byte(content), 0755)
 		if err != nil {
@@ -599,9 +1280,15 @@ func createSetupScript(config Config, targetDir string) error {
 	content := fmt.Sprintf(`#!/bin/sh
 mount -u /
 /init-network.sh
+if ! getent hosts pkg.FreeBSD.org >/dev/null; then
+  echo "VM has no network/DNS: cannot resolve pkg.FreeBSD.org using nameservers %s" >&2
+  echo "Check that the gvproxy forwarder is running and the host network is up" >&2
+  mount -fr /
+  exit 1
+fi
 pkg install -y %s
 mount -fr /
-`, strings.Join(config.Pkgs, " "))
+`, strings.Join(config.Network.Nameservers, " "), strings.Join(config.Pkgs, " "))
 	err = os.WriteFile(scriptPath, []byte(content), 0755)
 	if err != nil {
 		return fmt.Errorf("failed to write setup script: %w", err)
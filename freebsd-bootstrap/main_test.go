@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"anylinuxfs/freebsd-bootstrap/remoteiso"
+)
+
+func TestAddSymlinkCycle(t *testing.T) {
+	type link struct{ path, target string }
+	tests := []struct {
+		name  string
+		links []link
+		// cycle is the index of the first link expected to close a cycle,
+		// -1 if none does
+		cycle int
+	}{
+		{"chain", []link{{"/lib/a", "b"}, {"/lib/b", "/usr/lib/c"}}, -1},
+		{"self", []link{{"/lib/a", "./a"}}, 0},
+		{"two links", []link{{"/lib/a", "b"}, {"/lib/b", "a"}}, 1},
+		{"relative", []link{{"/lib/a", "../usr/lib/b"}, {"/usr/lib/b", "../../lib/a"}}, 1},
+		{"cycle past the start", []link{{"/bin/sh", "/lib/a"}, {"/lib/a", "b"}, {"/lib/b", "a"}}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDownloader("", nil, remoteiso.MatchOptions{})
+			for i, l := range tt.links {
+				_, err := d.addSymlink(l.path, l.target)
+				if i == tt.cycle {
+					if !errors.Is(err, errSymlinkCycle) {
+						t.Fatalf("addSymlink(%q, %q) = %v, want a symlink cycle error", l.path, l.target, err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("addSymlink(%q, %q): %v", l.path, l.target, err)
+				}
+			}
+			if tt.cycle >= 0 {
+				t.Fatalf("no cycle detected, want one at link %d", tt.cycle)
+			}
+		})
+	}
+}
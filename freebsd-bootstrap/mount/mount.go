@@ -14,6 +14,25 @@ func Mount(device, target, mType, options string) error {
 	return mount(device, target, mType, uintptr(flag), data)
 }
 
+// Unmount unmounts target. A target that is not mounted is not an error.
+func Unmount(target string) error {
+	return unmount(target, 0)
+}
+
+func unmount(target string, flags int) error {
+	err := unix.Unmount(target, flags)
+	if err == nil || err == unix.EINVAL {
+		// EINVAL: not a mount point
+		return nil
+	}
+	return &mountError{
+		op:     "umount",
+		target: target,
+		flags:  uintptr(flags),
+		err:    err,
+	}
+}
+
 func allocateIOVecs(options []string) ([]unix.Iovec, [][]byte) {
 	iovecs := make([]unix.Iovec, len(options))
 	buffers := make([][]byte, len(options))
@@ -44,6 +63,12 @@ func mount(device, target, mType string, flag uintptr, data string) error {
 	} else {
 		options = append(options, "fstype", mType, "from", device)
 	}
+	// pass fs specific key=value options (e.g. tmpfs size=1g) to nmount
+	for x := range strings.SplitSeq(data, ",") {
+		if key, value, ok := strings.Cut(x, "="); ok {
+			options = append(options, key, value)
+		}
+	}
 
 	iovecs, _ := allocateIOVecs(options)
 
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+const (
+	defaultGuestAddr = "192.168.127.2/24"
+	defaultGateway   = "192.168.127.1"
+)
+
+// NetworkConfig describes the guest side of the gvproxy network. It must
+// agree with the subnet gvproxy is started with on the host.
+type NetworkConfig struct {
+	// GuestAddr is the guest IP address with prefix length (CIDR notation).
+	GuestAddr string `json:"guest_addr"`
+	// Gateway is the default route and DNS server (served by gvproxy).
+	Gateway string `json:"gateway"`
+	// Nameservers replace the gateway as DNS servers if set.
+	Nameservers []string `json:"nameservers"`
+	// Search lists the DNS search domains.
+	Search []string `json:"search"`
+}
+
+func (n *NetworkConfig) setDefaults() {
+	if n.GuestAddr == "" {
+		n.GuestAddr = defaultGuestAddr
+	}
+	if n.Gateway == "" {
+		n.Gateway = defaultGateway
+	}
+	if len(n.Nameservers) == 0 {
+		n.Nameservers = []string{n.Gateway}
+	}
+}
+
+func (n NetworkConfig) validate() error {
+	prefix, err := netip.ParsePrefix(n.GuestAddr)
+	if err != nil {
+		return fmt.Errorf("invalid guest_addr %q: %w", n.GuestAddr, err)
+	}
+	gateway, err := netip.ParseAddr(n.Gateway)
+	if err != nil {
+		return fmt.Errorf("invalid gateway %q: %w", n.Gateway, err)
+	}
+	if !prefix.Addr().Is4() || !gateway.Is4() {
+		return fmt.Errorf("only IPv4 guest addressing is supported")
+	}
+	if !prefix.Contains(gateway) {
+		return fmt.Errorf("gateway %s is outside of the guest subnet %s", gateway, prefix.Masked())
+	}
+	if prefix.Addr() == gateway {
+		return fmt.Errorf("guest address and gateway are both %s", gateway)
+	}
+	if prefix.Addr() == prefix.Masked().Addr() {
+		return fmt.Errorf("guest address %s is the network address", prefix.Addr())
+	}
+	for _, ns := range n.Nameservers {
+		if _, err := netip.ParseAddr(ns); err != nil {
+			return fmt.Errorf("invalid nameserver %q: %w", ns, err)
+		}
+	}
+	for _, domain := range n.Search {
+		if domain == "" || strings.ContainsAny(domain, " \t") {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+	}
+	return nil
+}
+
+// resolvConf renders /etc/resolv.conf for the guest.
+func (n NetworkConfig) resolvConf() string {
+	var b strings.Builder
+	if len(n.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(n.Search, " "))
+	}
+	for _, ns := range n.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	return b.String()
+}
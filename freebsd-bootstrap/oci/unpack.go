@@ -2,8 +2,13 @@ package oci
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/apex/log"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -13,11 +18,33 @@ import (
 	"github.com/opencontainers/umoci/oci/layer"
 )
 
-func Unpack(imagePath, rootfsPath string) error {
-	var unpackOptions layer.UnpackOptions
-	var meta umoci.Meta
+// CheckLayout verifies that dir contains an OCI image layout (version file,
+// index and blobs directory), e.g. that the right disk got mounted.
+func CheckLayout(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, ispec.ImageLayoutFile))
+	if err != nil {
+		return fmt.Errorf("not an OCI image layout: %w", err)
+	}
+	var layout ispec.ImageLayout
+	if err := json.Unmarshal(data, &layout); err != nil {
+		return fmt.Errorf("parse %s: %w", ispec.ImageLayoutFile, err)
+	}
+	if layout.Version != ispec.ImageLayoutVersion {
+		return fmt.Errorf("unsupported OCI image layout version %q", layout.Version)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ispec.ImageIndexFile)); err != nil {
+		return fmt.Errorf("not an OCI image layout: %w", err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, ispec.ImageBlobsDir)); err != nil || !info.IsDir() {
+		return fmt.Errorf("not an OCI image layout: %s directory missing", ispec.ImageBlobsDir)
+	}
+	return nil
+}
 
-	unpackOptions.KeepDirlinks = true
+// Unpack extracts the image tagged tag in imagePath into rootfsPath. An
+// empty tag selects the first tagged image.
+func Unpack(imagePath, tag, rootfsPath string, unpackOptions layer.UnpackOptions) error {
+	var meta umoci.Meta
 
 	// Get a reference to the CAS.
 	engine, err := dir.Open(imagePath)
@@ -36,6 +63,12 @@ func Unpack(imagePath, rootfsPath string) error {
 	}
 
 	fromName := names[0]
+	if tag != "" {
+		if !slices.Contains(names, tag) {
+			return fmt.Errorf("tag %s not found, available tags: %s", tag, strings.Join(names, ", "))
+		}
+		fromName = tag
+	}
 	fromDescriptorPaths, err := engineExt.ResolveReference(context.Background(), fromName)
 	if err != nil {
 		return fmt.Errorf("get descriptor: %w", err)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// progressEvent is one line of -progress json output.
+type progressEvent struct {
+	Phase   string  `json:"phase"`
+	File    string  `json:"file,omitempty"`
+	Files   int64   `json:"files,omitempty"`
+	Bytes   int64   `json:"bytes,omitempty"`
+	Percent float64 `json:"percent,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// progressEmitter writes newline-delimited JSON events. A nil
+// *progressEmitter (the default text mode) emits nothing.
+type progressEmitter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// events is set by -progress json.
+var events *progressEmitter
+
+func newProgressEmitter(w io.Writer) *progressEmitter {
+	return &progressEmitter{enc: json.NewEncoder(w)}
+}
+
+func (p *progressEmitter) emit(e progressEvent) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.enc.Encode(e)
+}
+
+func (p *progressEmitter) phase(name string) {
+	p.emit(progressEvent{Phase: name})
+}
+
+func (p *progressEmitter) fail(phase string, err error) {
+	p.emit(progressEvent{Phase: phase, Error: err.Error()})
+}
+
+// percent of done in total, capped at 100 since totals are estimates.
+func percent(done, total int64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return min(100, float64(done)*100/float64(total))
+}
@@ -0,0 +1,104 @@
+package remoteiso
+
+import (
+	"anylinuxfs/common-go/ratelimit"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientOptions configures the HTTP client used to fetch the ISO.
+type ClientOptions struct {
+	// Timeout bounds each request.
+	Timeout time.Duration
+	// ProxyURL overrides the HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment
+	// variables which are used when it's empty.
+	ProxyURL string
+	// RootCAs replaces the system CA pool when set (see LoadCABundle).
+	RootCAs *x509.CertPool
+	// MaxIdleConns is the number of keep-alive connections kept open to the
+	// ISO server. Defaults to DefaultMaxIdleConns when zero.
+	MaxIdleConns int
+	// MaxBytesPerSec caps the download rate of all requests made with the
+	// client combined (unlimited when zero). Timeout then only bounds the
+	// wait for response headers since throttled bodies take longer to read.
+	MaxBytesPerSec int64
+}
+
+// DefaultMaxIdleConns keeps a few connections warm so consecutive range
+// requests don't pay for a new TCP and TLS handshake each.
+const DefaultMaxIdleConns = 4
+
+var (
+	defaultClient     *http.Client
+	defaultClientOnce sync.Once
+)
+
+// DefaultHTTPClient is used by HTTPReaderAt when no Client is set.
+func DefaultHTTPClient() *http.Client {
+	defaultClientOnce.Do(func() {
+		// cannot fail without a proxy URL
+		defaultClient, _ = NewHTTPClient(ClientOptions{})
+	})
+	return defaultClient
+}
+
+// LoadCABundle returns the system CA pool extended with the certificates of
+// the PEM file at path. The bootstrap loads it before the chroot, after
+// which host paths are no longer reachable.
+func LoadCABundle(path string) (*x509.CertPool, error) {
+	certs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(certs) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// NewHTTPClient builds an HTTP client honoring the proxy and CA settings.
+func NewHTTPClient(opts ClientOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	maxIdle := opts.MaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = DefaultMaxIdleConns
+	}
+	// all requests go to a single host, so the per-host limit (2 by default)
+	// is the one that matters
+	transport.MaxIdleConns = maxIdle
+	transport.MaxIdleConnsPerHost = maxIdle
+
+	if opts.ProxyURL != "" {
+		proxy, err := url.Parse(opts.ProxyURL)
+		if err != nil || proxy.Scheme == "" || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", opts.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	if opts.RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: opts.RootCAs}
+	}
+
+	if limiter := ratelimit.New(opts.MaxBytesPerSec); limiter != nil {
+		transport.ResponseHeaderTimeout = opts.Timeout
+		return &http.Client{
+			Transport: ratelimit.Transport(transport, limiter),
+		}, nil
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+	}, nil
+}
@@ -0,0 +1,162 @@
+package remoteiso
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Compression of an ISO artifact. Compressed streams can't be read at
+// arbitrary offsets, so such images are decompressed to a local file first.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Xz
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Xz:
+		return "xz"
+	default:
+		return "none"
+	}
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// DetectCompression looks at the first bytes of the image, falling back to
+// the URL extension if they cannot be read.
+func DetectCompression(r io.ReaderAt, url string) Compression {
+	header := make([]byte, len(xzMagic))
+	if n, _ := r.ReadAt(header, 0); n == len(header) {
+		switch {
+		case bytes.HasPrefix(header, xzMagic):
+			return Xz
+		case bytes.HasPrefix(header, gzipMagic):
+			return Gzip
+		default:
+			return Uncompressed
+		}
+	}
+	switch {
+	case strings.HasSuffix(url, ".xz"):
+		return Xz
+	case strings.HasSuffix(url, ".gz"):
+		return Gzip
+	default:
+		return Uncompressed
+	}
+}
+
+// DecompressedName is the file name DecompressToCache stores the image
+// from url under.
+func DecompressedName(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8]) + ".iso"
+}
+
+// DecompressToCache downloads the whole image from url and decompresses it
+// into cache, returning the raw ISO opened for reading. An image
+// decompressed by a previous run is reused. The result is as large as the
+// uncompressed ISO, so cache should not be on a memory-backed filesystem.
+// cache is an os.Root so that it stays usable after a chroot.
+func DecompressToCache(ctx context.Context, client *http.Client, url string, comp Compression, cache *os.Root) (*os.File, error) {
+	name := DecompressedName(url)
+	if f, err := cache.Open(name); err == nil {
+		fmt.Printf("Using decompressed image %s\n", filepath.Join(cache.Name(), name))
+		return f, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = DefaultHTTPClient()
+	}
+	// the download takes much longer than a single range request
+	c := *client
+	c.Timeout = 0
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	TotalRequests.Add(1)
+	counted := &countingReader{r: resp.Body}
+
+	var decompressed io.Reader
+	switch comp {
+	case Gzip:
+		zr, err := gzip.NewReader(counted)
+		if err != nil {
+			return nil, fmt.Errorf("read gzip header: %w", err)
+		}
+		defer zr.Close()
+		decompressed = zr
+	case Xz:
+		xr, err := xz.NewReader(bufio.NewReader(counted))
+		if err != nil {
+			return nil, fmt.Errorf("read xz header: %w", err)
+		}
+		decompressed = xr
+	default:
+		return nil, fmt.Errorf("%s is not compressed", url)
+	}
+
+	// decompress under a temporary name so that an interrupted run is not
+	// mistaken for a complete image
+	partName := name + ".part"
+	f, err := cache.Create(partName)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.CopyBuffer(f, decompressed, make([]byte, copyBufferSize))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cache.Remove(partName)
+		return nil, fmt.Errorf("decompress %s: %w", url, err)
+	}
+	if err := cache.Rename(partName, name); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Decompressed %s image: %d bytes downloaded, %d bytes on disk\n", comp, counted.n, n)
+	return cache.Open(name)
+}
+
+// countingReader adds the bytes it reads to TotalBytesRead.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	TotalBytesRead.Add(int64(n))
+	return n, err
+}
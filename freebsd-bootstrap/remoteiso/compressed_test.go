@@ -0,0 +1,52 @@
+package remoteiso
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestDecompressToCache(t *testing.T) {
+	data := testData(100_000)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv := newRangeServer(t, gz.Bytes())
+	url := srv.URL + "/image.iso.gz"
+
+	cache, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	for range 2 {
+		f, err := DecompressToCache(context.Background(), srv.Client(), url, Gzip, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("decompressed image differs from the original")
+		}
+	}
+	// the second call reuses the image decompressed by the first one
+	if got := srv.requests(); len(got) != 1 {
+		t.Errorf("requests = %q, want one download", got)
+	}
+	if _, err := cache.Stat(DecompressedName(url) + ".part"); !os.IsNotExist(err) {
+		t.Errorf("partial image left in the cache: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package remoteiso
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+const (
+	sectorSize = 2048
+	// volume descriptors start at sector 16 and end with a terminator
+	firstVolumeDescriptor = 16
+	maxVolumeDescriptors  = 32
+
+	// prefetchGap is the largest gap between directory extents which is
+	// fetched along with them rather than split into another request.
+	prefetchGap = 1024 * 1024
+	// prefetchMaxRun bounds a single prefetch request.
+	prefetchMaxRun = 32 * 1024 * 1024
+)
+
+var standardIdentifier = []byte("CD001")
+
+// PrefetchDirectories loads the directory records of the image into the
+// cache, so that walking the tree (FindFiles) doesn't need a request per
+// directory. The directory extents are taken from the ISO 9660 path table;
+// extents close to each other are fetched with a single range request.
+// Returns the number of directories in the image.
+func (c *CachedReaderAt) PrefetchDirectories() (int, error) {
+	blockSize, tableSize, tableLoc, err := c.readPathTableLocation()
+	if err != nil {
+		return 0, err
+	}
+	table := make([]byte, tableSize)
+	if _, err := c.ReadAt(table, tableLoc*blockSize); err != nil {
+		return 0, fmt.Errorf("read path table: %w", err)
+	}
+
+	// L path table records: name length, extended attribute length,
+	// extent (LE32), parent number (LE16), name padded to an even length
+	var extents []int64
+	for off := 0; off+8 <= len(table); {
+		nameLen := int(table[off])
+		if nameLen == 0 {
+			break
+		}
+		extent := int64(binary.LittleEndian.Uint32(table[off+2:]))
+		extents = append(extents, extent*blockSize)
+		off += 8 + nameLen + nameLen%2
+	}
+	slices.Sort(extents)
+
+	for i := 0; i < len(extents); {
+		start := extents[i]
+		end := start + blockSize
+		for i++; i < len(extents); i++ {
+			next := extents[i]
+			if next-end > prefetchGap || next+blockSize-start > prefetchMaxRun {
+				break
+			}
+			end = max(end, next+blockSize)
+		}
+		if _, err := c.ReadAt(make([]byte, end-start), start); err != nil {
+			return 0, fmt.Errorf("prefetch directories: %w", err)
+		}
+	}
+	return len(extents), nil
+}
+
+// readPathTableLocation finds the primary volume descriptor and returns
+// the logical block size and the size and location of the L path table.
+func (c *CachedReaderAt) readPathTableLocation() (blockSize, tableSize, tableLoc int64, err error) {
+	vd := make([]byte, sectorSize)
+	for sector := int64(firstVolumeDescriptor); sector < firstVolumeDescriptor+maxVolumeDescriptors; sector++ {
+		if _, err := c.ReadAt(vd, sector*sectorSize); err != nil {
+			return 0, 0, 0, fmt.Errorf("read volume descriptor: %w", err)
+		}
+		if !bytes.Equal(vd[1:6], standardIdentifier) {
+			break
+		}
+		switch vd[0] {
+		case 1: // primary volume descriptor
+			blockSize = int64(binary.LittleEndian.Uint16(vd[128:]))
+			tableSize = int64(binary.LittleEndian.Uint32(vd[132:]))
+			tableLoc = int64(binary.LittleEndian.Uint32(vd[140:]))
+			if blockSize == 0 || tableSize == 0 {
+				return 0, 0, 0, fmt.Errorf("image has no path table")
+			}
+			return blockSize, tableSize, tableLoc, nil
+		case 255: // terminator
+			return 0, 0, 0, fmt.Errorf("no primary volume descriptor found")
+		}
+	}
+	return 0, 0, 0, fmt.Errorf("no primary volume descriptor found")
+}
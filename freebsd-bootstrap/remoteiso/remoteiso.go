@@ -1,12 +1,16 @@
 package remoteiso
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/kdomanski/iso9660"
 )
@@ -15,9 +19,18 @@ import (
 type FileEntry struct {
 	File *iso9660.File
 	Path string
+	// Target, if set for a symlink, is the file it points to, whose contents
+	// are then downloaded in place of the link
+	Target *iso9660.File
 }
 
-func (entry FileEntry) Download(baseDir string) (string, error) {
+// Download copies the file (or recreates the symlink) under baseDir. If ctx
+// is cancelled, the copy stops and the partially written file is removed.
+func (entry FileEntry) Download(ctx context.Context, baseDir string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
 	// Create the full local path
 	localPath := filepath.Join(baseDir, entry.Path)
 	// fmt.Printf("Downloading %s to %s\n", entry.Path, localPath)
@@ -28,15 +41,15 @@ func (entry FileEntry) Download(baseDir string) (string, error) {
 		return "", fmt.Errorf("failed to create directory %s: %w", dir, err)
 	}
 
-	if entry.File.Mode()&os.ModeSymlink != 0 {
-		origTarget := entry.File.SymlinkTarget()
+	file := entry.File
+	if file.Mode()&os.ModeSymlink != 0 && entry.Target != nil {
+		file = entry.Target
+	} else if file.Mode()&os.ModeSymlink != 0 {
+		origTarget := file.SymlinkTarget()
 		if origTarget == "" {
 			return "", fmt.Errorf("symlink target for %s is empty", entry.Path)
 		}
-		target := origTarget
-		if strings.HasPrefix(origTarget, "/") {
-			target = filepath.Join(baseDir, origTarget)
-		}
+		target := RebaseSymlinkTarget(entry.Path, origTarget)
 		if _, err := os.Lstat(localPath); err == nil {
 			_ = os.Remove(localPath)
 		}
@@ -48,58 +61,124 @@ func (entry FileEntry) Download(baseDir string) (string, error) {
 	}
 
 	// Create the local file (but first remove it to reset permissions too)
-	_ = os.Chmod(localPath, entry.File.Mode()|0200) // ensure write permission before deleting
+	_ = os.Chmod(localPath, file.Mode()|0200) // ensure write permission before deleting
 	_ = os.Remove(localPath)
-	localFile, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, entry.File.Mode())
+	localFile, err := os.OpenFile(localPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, file.Mode())
 	if err != nil {
 		return "", fmt.Errorf("failed to create file %s: %w", localPath, err)
 	}
 	defer localFile.Close()
 
 	// Get reader for the ISO file content
-	reader := entry.File.Reader()
-
-	// Copy content
-	_, err = io.Copy(localFile, reader)
+	reader := &contextReader{ctx: ctx, r: file.Reader()}
+
+	// Copy content in large chunks so that each ReadAt spans several cache
+	// blocks, which are then fetched with one range request. The writer is
+	// wrapped to keep io.CopyBuffer from using (*os.File).ReadFrom and its
+	// own small buffer.
+	buf := make([]byte, copyBufferSize)
+	_, err = io.CopyBuffer(struct{ io.Writer }{localFile}, reader, buf)
 	if err != nil {
+		localFile.Close()
+		_ = os.Remove(localPath)
 		return "", fmt.Errorf("failed to copy content to %s: %w", localPath, err)
 	}
 
-	fmt.Printf("Downloaded %s (%d bytes)\n", entry.Path, entry.File.Size())
+	fmt.Printf("Downloaded %s (%d bytes)\n", entry.Path, file.Size())
 	return localPath, nil
 }
 
+// RebaseSymlinkTarget returns target (of a symlink at linkPath, both as seen
+// in the ISO) relative to the link's directory, so that the link resolves
+// within whatever tree it is downloaded into and later copied to. Absolute
+// targets become relative and relative ones climbing above the root are
+// clamped to it, the way they would resolve on the ISO.
+func RebaseSymlinkTarget(linkPath, target string) string {
+	linkDir := path.Dir(path.Clean("/" + linkPath))
+	resolved := target
+	if !path.IsAbs(target) {
+		resolved = path.Join(linkDir, target)
+	}
+	rel, err := filepath.Rel(linkDir, path.Clean(resolved))
+	if err != nil {
+		// both paths are absolute, so this can't happen
+		return target
+	}
+	return filepath.ToSlash(rel)
+}
+
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 // HTTPReaderAt implements io.ReaderAt backed by HTTP Range requests.
+// Client can be set to a custom client (see NewHTTPClient); when nil,
+// DefaultHTTPClient is used. Cancelling Context aborts in-flight requests;
+// io.ReaderAt has no way to pass a context per call.
 type HTTPReaderAt struct {
-	URL    string
-	Client *http.Client
+	URL     string
+	Client  *http.Client
+	Context context.Context
 }
 
-var TotalBytesRead int64 = 0
+// TotalBytesRead counts the bytes requested from the ISO server.
+var TotalBytesRead atomic.Int64
+
+// TotalRequests counts the HTTP range requests issued by HTTPReaderAt.
+var TotalRequests atomic.Int64
+
+// copyBufferSize is the chunk size FileEntry.Download reads with.
+const copyBufferSize = 1024 * 1024
 
 // ReadAt reads len(p) bytes starting at offset off.
 func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
 	// fmt.Printf("HTTP ReadAt: offset=%d, length=%d\n", off, len(p))
-	TotalBytesRead += int64(len(p))
+	TotalBytesRead.Add(int64(len(p)))
+	TotalRequests.Add(1)
 
 	end := off + int64(len(p)) - 1
-	req, err := http.NewRequest("GET", r.URL, nil)
+	ctx := r.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", r.URL, nil)
 	if err != nil {
 		return 0, err
 	}
 	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, end))
 
-	resp, err := r.Client.Do(req)
+	client := r.Client
+	if client == nil {
+		client = DefaultHTTPClient()
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return 0, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the range starts at or past the end of the file
+		return 0, io.EOF
+	}
 	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
 		return 0, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
 	}
 
 	n, err := io.ReadFull(resp.Body, p)
+	if resp.StatusCode == http.StatusPartialContent {
+		// reach EOF so that the connection goes back to the idle pool
+		_, _ = io.Copy(io.Discard, resp.Body)
+	}
 	if err == io.ErrUnexpectedEOF {
 		// Allow short reads at EOF
 		return n, io.EOF
@@ -107,37 +186,166 @@ func (r *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
 	return n, err
 }
 
+// DefaultBlockSize is a good trade-off for ISO images: large enough to
+// keep the number of range requests low when reading file contents, small
+// enough not to over-fetch when walking directory records. Block sizes
+// should be a multiple of the 2 KiB ISO sector size.
+const DefaultBlockSize = 128 * 1024
+
+// cacheShards spreads the cached blocks over independently locked maps so
+// that concurrent reads of different blocks rarely contend.
+const cacheShards = 16
+
+type cacheShard struct {
+	mu     sync.RWMutex
+	blocks map[int64][]byte // key = block number
+}
+
+// CachedReaderAt caches BlockSize-aligned blocks read from Base. It is safe
+// for concurrent use; two readers missing the same block may both fetch it.
+// Use NewCachedReaderAt to get a validated instance.
 type CachedReaderAt struct {
 	Base      *HTTPReaderAt
 	BlockSize int64
-	Cache     map[int64][]byte // key = block number
+	shards    [cacheShards]cacheShard
+
+	hits         atomic.Int64
+	misses       atomic.Int64
+	bytesServed  atomic.Int64
+	bytesFetched atomic.Int64
+}
+
+// CacheStats describes how well a CachedReaderAt's cache has worked so far.
+type CacheStats struct {
+	Hits   int64 // blocks found in the cache
+	Misses int64 // blocks fetched from Base
+	// BytesServed were returned by ReadAt, BytesFetched read from Base
+	BytesServed  int64
+	BytesFetched int64
+}
+
+// HitRatio is the fraction of blocks found in the cache, 0 if none were
+// looked up yet.
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Stats returns the counters of this reader.
+func (c *CachedReaderAt) Stats() CacheStats {
+	return CacheStats{
+		Hits:         c.hits.Load(),
+		Misses:       c.misses.Load(),
+		BytesServed:  c.bytesServed.Load(),
+		BytesFetched: c.bytesFetched.Load(),
+	}
+}
+
+func (c *CachedReaderAt) shard(blk int64) *cacheShard {
+	return &c.shards[uint64(blk)%cacheShards]
+}
+
+func (c *CachedReaderAt) get(blk int64) ([]byte, bool) {
+	s := c.shard(blk)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blocks[blk]
+	return data, ok
+}
+
+func (c *CachedReaderAt) put(blk int64, data []byte) {
+	s := c.shard(blk)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blocks == nil {
+		s.blocks = make(map[int64][]byte)
+	}
+	s.blocks[blk] = data
+}
+
+func NewCachedReaderAt(base *HTTPReaderAt, blockSize int64) (*CachedReaderAt, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size %d: must be positive", blockSize)
+	}
+	return &CachedReaderAt{
+		Base:      base,
+		BlockSize: blockSize,
+	}, nil
 }
 
 func (c *CachedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if c.BlockSize <= 0 {
+		return 0, fmt.Errorf("invalid block size %d: must be positive", c.BlockSize)
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("invalid offset %d: must not be negative", off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
 	startBlock := off / c.BlockSize
 	endBlock := (off + int64(len(p)) - 1) / c.BlockSize
 
+	if err := c.fetchMissing(startBlock, endBlock); err != nil {
+		return 0, err
+	}
+
 	var read int
 	for blk := startBlock; blk <= endBlock; blk++ {
 		blockOff := blk * c.BlockSize
-		data, ok := c.Cache[blk]
-		if !ok {
-			buf := make([]byte, c.BlockSize)
-			_, err := c.Base.ReadAt(buf, blockOff)
-			if err != nil && err != io.EOF {
-				return read, err
-			}
-			c.Cache[blk] = buf
-			data = buf
-		}
+		data, _ := c.get(blk)
 		blockStart := max(off, blockOff)
 		blockEnd := min(off+int64(len(p)), blockOff+int64(len(data)))
+		if blockEnd <= blockStart {
+			// past the short final block
+			break
+		}
 		copy(p[blockStart-off:blockEnd-off], data[blockStart-blockOff:blockEnd-blockOff])
 		read += int(blockEnd - blockStart)
 	}
+	c.bytesServed.Add(int64(read))
+	if read < len(p) {
+		return read, io.EOF
+	}
 	return read, nil
 }
 
+// fetchMissing loads the uncached blocks in [startBlock, endBlock], issuing
+// a single range request for each run of consecutive missing blocks. Blocks
+// at the end of the file are cached with their actual (shorter) length.
+func (c *CachedReaderAt) fetchMissing(startBlock, endBlock int64) error {
+	for blk := startBlock; blk <= endBlock; blk++ {
+		if _, ok := c.get(blk); ok {
+			c.hits.Add(1)
+			continue
+		}
+		runEnd := blk
+		for runEnd < endBlock {
+			if _, ok := c.get(runEnd + 1); ok {
+				break
+			}
+			runEnd++
+		}
+		c.misses.Add(runEnd - blk + 1)
+
+		buf := make([]byte, (runEnd-blk+1)*c.BlockSize)
+		n, err := c.Base.ReadAt(buf, blk*c.BlockSize)
+		c.bytesFetched.Add(int64(n))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		for i := blk; i <= runEnd; i++ {
+			start := (i - blk) * c.BlockSize
+			end := min(start+c.BlockSize, max(int64(n), start))
+			c.put(i, buf[start:end:end])
+		}
+		blk = runEnd
+	}
+	return nil
+}
+
 func ListDir(dir *iso9660.File, prefix string) {
 	entries, err := dir.GetChildren()
 	if err != nil {
@@ -152,11 +360,18 @@ func ListDir(dir *iso9660.File, prefix string) {
 	}
 }
 
-func FindFiles(root *iso9660.File, paths []string) []*FileEntry {
+// MatchOptions controls how path components are compared with ISO names.
+type MatchOptions struct {
+	// CaseSensitive disables the case-insensitive fallback used for images
+	// without Rock Ridge extensions, where names are stored uppercase.
+	CaseSensitive bool
+}
+
+func FindFiles(root *iso9660.File, paths []string, opts MatchOptions) []*FileEntry {
 	var found []*FileEntry
 
 	for _, targetPath := range paths {
-		if file := findFileByPath(root, targetPath); file != nil {
+		if file := findFileByPath(root, targetPath, opts); file != nil {
 			found = append(found, &FileEntry{
 				File: file,
 				Path: targetPath,
@@ -167,38 +382,16 @@ func FindFiles(root *iso9660.File, paths []string) []*FileEntry {
 	return found
 }
 
-func findFileByPath(root *iso9660.File, targetPath string) *iso9660.File {
-	// Handle root path
-	if targetPath == "/" || targetPath == "" {
-		return root
-	}
-
-	// Split path into components, removing empty strings
-	pathParts := []string{}
-	for _, part := range splitPath(targetPath) {
-		if part != "" {
-			pathParts = append(pathParts, part)
-		}
-	}
-	// fmt.Printf("DEBUG pathParts: %v\n", pathParts)
-
-	// Start from root and traverse down
+func findFileByPath(root *iso9660.File, targetPath string, opts MatchOptions) *iso9660.File {
+	// Start from root and traverse down (the root path has no components)
 	current := root
-	for _, part := range pathParts {
+	for _, part := range splitPath(targetPath) {
 		entries, err := current.GetChildren()
 		if err != nil {
 			return nil
 		}
 
-		// Look for the part in current directory
-		var found *iso9660.File
-		for _, entry := range entries {
-			if entry.Name() == part {
-				found = entry
-				break
-			}
-		}
-
+		found := findEntry(entries, part, opts)
 		if found == nil {
 			return nil // Path component not found
 		}
@@ -209,26 +402,39 @@ func findFileByPath(root *iso9660.File, targetPath string) *iso9660.File {
 	return current
 }
 
-// Simple path splitter (splits on '/' and filters empty strings)
-func splitPath(path string) []string {
-	var parts []string
-	current := ""
-
-	for i, char := range path {
-		if char == '/' {
-			if current != "" {
-				parts = append(parts, current)
-				current = ""
-			}
-		} else {
-			current += string(char)
+// findEntry looks for name among directory entries. An exact match always
+// wins; otherwise names are compared after normalization (see normalizeName).
+func findEntry(entries []*iso9660.File, name string, opts MatchOptions) *iso9660.File {
+	for _, entry := range entries {
+		if entry.Name() == name {
+			return entry
 		}
+	}
 
-		// Add last part if we're at the end
-		if i == len(path)-1 && current != "" {
-			parts = append(parts, current)
+	want := normalizeName(name, opts)
+	for _, entry := range entries {
+		if normalizeName(entry.Name(), opts) == want {
+			return entry
 		}
 	}
+	return nil
+}
 
-	return parts
+// normalizeName strips an iso9660 version suffix (";1") and the trailing dot
+// of names without extension and, unless opts.CaseSensitive, folds the case.
+func normalizeName(name string, opts MatchOptions) string {
+	name, _, _ = strings.Cut(name, ";")
+	if len(name) > 1 {
+		name = strings.TrimSuffix(name, ".")
+	}
+	if !opts.CaseSensitive {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// splitPath splits path on '/' dropping empty components, so leading,
+// trailing and repeated slashes are ignored ("/a//b/" -> ["a", "b"]).
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
 }
@@ -0,0 +1,362 @@
+package remoteiso
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kdomanski/iso9660"
+)
+
+// rangeServer serves an image with Range support and records the Range
+// header of every request.
+type rangeServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newRangeServer(t *testing.T, data []byte) *rangeServer {
+	t.Helper()
+	s := &rangeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		http.ServeContent(w, r, "image.iso", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requests returns the Range headers received so far.
+func (s *rangeServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.ranges)
+}
+
+func (s *rangeServer) cachedReader(t *testing.T, blockSize int64) *CachedReaderAt {
+	t.Helper()
+	c, err := NewCachedReaderAt(&HTTPReaderAt{URL: s.URL, Client: s.Client()}, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// buildISO returns an ISO 9660 image (without Rock Ridge, so names are
+// stored in lowercase with a version suffix) holding files.
+func buildISO(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	w, err := iso9660.NewWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Cleanup()
+	for name, content := range files {
+		if err := w.AddFile(strings.NewReader(content), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := w.WriteTo(&buf, "TEST"); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func openRoot(t *testing.T, r *CachedReaderAt) *iso9660.File {
+	t.Helper()
+	image, err := iso9660.OpenImage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := image.RootDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// legacySplitPath is the splitter splitPath replaced, kept as a reference
+// for the inputs it handled correctly.
+func legacySplitPath(path string) []string {
+	var parts []string
+	current := ""
+
+	for i, char := range path {
+		if char == '/' {
+			if current != "" {
+				parts = append(parts, current)
+				current = ""
+			}
+		} else {
+			current += string(char)
+		}
+
+		// Add last part if we're at the end
+		if i == len(path)-1 && current != "" {
+			parts = append(parts, current)
+		}
+	}
+
+	return parts
+}
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+		// legacy is false where the old splitter was wrong: it only flushed
+		// the last component if the final rune was a single byte
+		legacy bool
+	}{
+		{"", nil, true},
+		{"/", nil, true},
+		{"//", nil, true},
+		{"a", []string{"a"}, true},
+		{"/a", []string{"a"}, true},
+		{"a/", []string{"a"}, true},
+		{"/a/b/c", []string{"a", "b", "c"}, true},
+		{"/a//b///c/", []string{"a", "b", "c"}, true},
+		{"/lib/libc.so.7", []string{"lib", "libc.so.7"}, true},
+		{"/usr/share/ä/b", []string{"usr", "share", "ä", "b"}, true},
+		{"/usr/share/ä", []string{"usr", "share", "ä"}, false},
+		{"/日本/語", []string{"日本", "語"}, false},
+		{"/日本//語/", []string{"日本", "語"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got := splitPath(tt.path)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("splitPath(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+			if legacy := legacySplitPath(tt.path); tt.legacy && !slices.Equal(got, legacy) {
+				t.Errorf("splitPath(%q) = %q, the previous splitter returned %q", tt.path, got, legacy)
+			}
+		})
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name          string
+		caseSensitive bool
+		want          string
+	}{
+		{"KERNEL;1", false, "kernel"},
+		{"KERNEL;1", true, "KERNEL"},
+		{"README.;1", false, "readme"},
+		{"README.", true, "README"},
+		{"rc.conf", false, "rc.conf"},
+		{"LIBC.SO.7;1", false, "libc.so.7"},
+		{"a.b.", false, "a.b"},
+		{".", false, "."},
+		{"", false, ""},
+	}
+	for _, tt := range tests {
+		got := normalizeName(tt.name, MatchOptions{CaseSensitive: tt.caseSensitive})
+		if got != tt.want {
+			t.Errorf("normalizeName(%q, caseSensitive=%v) = %q, want %q", tt.name, tt.caseSensitive, got, tt.want)
+		}
+	}
+}
+
+func TestFindFilesMatchesNormalizedNames(t *testing.T) {
+	srv := newRangeServer(t, buildISO(t, map[string]string{
+		"boot/kernel/kernel": "kernel",
+		"etc/rc.conf":        "rc",
+		"bin/sh":             "sh",
+	}))
+	// the whole image fits into one block
+	root := openRoot(t, srv.cachedReader(t, DefaultBlockSize))
+
+	paths := []string{"/BOOT/KERNEL/KERNEL", "/etc/rc.conf", "/Bin/Sh", "/bin/missing"}
+	var got []string
+	for _, entry := range FindFiles(root, paths, MatchOptions{}) {
+		got = append(got, entry.Path)
+	}
+	if want := paths[:3]; !slices.Equal(got, want) {
+		t.Errorf("found %q, want %q", got, want)
+	}
+
+	found := FindFiles(root, paths, MatchOptions{CaseSensitive: true})
+	if len(found) != 1 || found[0].Path != "/etc/rc.conf" {
+		t.Errorf("case-sensitive lookup found %d files, want only /etc/rc.conf", len(found))
+	}
+
+	want := []string{"bytes=0-131071"}
+	if reqs := srv.requests(); !slices.Equal(reqs, want) {
+		t.Errorf("requests = %q, want %q (all lookups served from the cache)", reqs, want)
+	}
+}
+
+func TestCachedReaderAtBlockSize(t *testing.T) {
+	for _, size := range []int64{0, -1, -DefaultBlockSize} {
+		if _, err := NewCachedReaderAt(&HTTPReaderAt{}, size); err == nil {
+			t.Errorf("NewCachedReaderAt accepted block size %d", size)
+		}
+	}
+	// a zero value bypassing the constructor must not divide by zero
+	var c CachedReaderAt
+	if _, err := c.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Error("ReadAt with a zero block size succeeded")
+	}
+}
+
+// testData returns n bytes that differ at every offset (mod 251).
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestCachedReaderAtFetchesMissingRuns(t *testing.T) {
+	// 10 full blocks and a short final one
+	data := testData(10*1000 + 300)
+	srv := newRangeServer(t, data)
+	c := srv.cachedReader(t, 1000)
+
+	steps := []struct {
+		off, n   int
+		wantN    int
+		wantEOF  bool
+		requests []string // issued by this read
+	}{
+		// consecutive missing blocks take one request
+		{off: 500, n: 2000, wantN: 2000, requests: []string{"bytes=0-2999"}},
+		// block 2 is cached, 3 and 4 are fetched together
+		{off: 2500, n: 2000, wantN: 2000, requests: []string{"bytes=3000-4999"}},
+		{off: 1200, n: 100, wantN: 100},
+		// a cached block splits the missing ones into two runs
+		{off: 6000, n: 100, wantN: 100, requests: []string{"bytes=6000-6999"}},
+		{off: 5000, n: 3000, wantN: 3000, requests: []string{"bytes=5000-5999", "bytes=7000-7999"}},
+		// the short final block is cached with its actual length
+		{off: 10100, n: 500, wantN: 200, wantEOF: true, requests: []string{"bytes=10000-10999"}},
+		{off: 10250, n: 10, wantN: 10},
+		{off: 10290, n: 20, wantN: 10, wantEOF: true},
+	}
+	var issued int
+	for _, step := range steps {
+		p := make([]byte, step.n)
+		n, err := c.ReadAt(p, int64(step.off))
+		if n != step.wantN || (err == io.EOF) != step.wantEOF || (err != nil && err != io.EOF) {
+			t.Fatalf("ReadAt(%d bytes at %d) = %d, %v; want %d (EOF %v)", step.n, step.off, n, err, step.wantN, step.wantEOF)
+		}
+		if !bytes.Equal(p[:n], data[step.off:step.off+n]) {
+			t.Errorf("ReadAt(%d bytes at %d) returned wrong data", step.n, step.off)
+		}
+		reqs := srv.requests()
+		if got := reqs[issued:]; !slices.Equal(got, step.requests) {
+			t.Errorf("ReadAt(%d bytes at %d) issued %q, want %q", step.n, step.off, got, step.requests)
+		}
+		issued = len(reqs)
+	}
+
+	// blocks 8 and 9 were never read
+	if fetched := c.Stats().BytesFetched; fetched != int64(len(data))-2000 {
+		t.Errorf("fetched %d bytes, want %d", fetched, len(data)-2000)
+	}
+}
+
+func TestCachedReaderAtConcurrentReads(t *testing.T) {
+	data := testData(256*1024 + 123)
+	srv := newRangeServer(t, data)
+	c := srv.cachedReader(t, 4096)
+
+	const workers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Go(func() {
+			// overlapping reads of different sizes, so that workers race
+			// for the same blocks and shards
+			for i := range 200 {
+				off := (w*7919 + i*104729) % len(data)
+				p := make([]byte, 1+(i*31)%20000)
+				n, err := c.ReadAt(p, int64(off))
+				if err != nil && err != io.EOF {
+					errs <- err
+					return
+				}
+				if want := min(len(p), len(data)-off); n != want || !bytes.Equal(p[:n], data[off:off+n]) {
+					errs <- fmt.Errorf("ReadAt(%d bytes at %d) = %d bytes, want %d of the image", len(p), off, n, want)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestReadPastEnd(t *testing.T) {
+	data := testData(1000)
+	srv := newRangeServer(t, data)
+
+	r := &HTTPReaderAt{URL: srv.URL, Client: srv.Client()}
+	for _, off := range []int64{1000, 5000} {
+		n, err := r.ReadAt(make([]byte, 10), off)
+		if n != 0 || err != io.EOF {
+			t.Errorf("HTTPReaderAt.ReadAt at %d = %d, %v; want 0, EOF", off, n, err)
+		}
+	}
+
+	c := srv.cachedReader(t, 512)
+	before := len(srv.requests())
+	n, err := c.ReadAt(make([]byte, 10), 1024)
+	if n != 0 || err != io.EOF {
+		t.Errorf("CachedReaderAt.ReadAt past the end = %d, %v; want 0, EOF", n, err)
+	}
+	if _, err := c.ReadAt(make([]byte, 10), -1); err == nil || err == io.EOF {
+		t.Errorf("CachedReaderAt.ReadAt at a negative offset = %v, want an error", err)
+	}
+	want := []string{"bytes=1024-1535"}
+	if got := srv.requests()[before:]; !slices.Equal(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
+
+func TestRebaseSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		link, target, want string
+	}{
+		// absolute targets become relative to the link's directory
+		{"/lib/libc.so", "/lib/libc.so.7", "libc.so.7"},
+		{"/usr/lib/libc.so", "/lib/libc.so.7", "../../lib/libc.so.7"},
+		{"/bin/sh", "/", ".."},
+		// relative targets are kept, but cleaned
+		{"/usr/lib/libm.so", "libm.so.5", "libm.so.5"},
+		{"/usr/lib/libm.so", "./libm.so.5", "libm.so.5"},
+		{"/usr/lib/libz.so", "../../lib/libz.so.6", "../../lib/libz.so.6"},
+		{"/usr/bin/x", "../lib//y/./z", "../lib/y/z"},
+		// targets climbing above the root are clamped to it
+		{"/usr/lib/libc.so", "../../../../lib/libc.so.7", "../../lib/libc.so.7"},
+		{"/a", "../../../etc/passwd", "etc/passwd"},
+		{"/a", "/../../etc/passwd", "etc/passwd"},
+		// link paths without a leading slash are relative to the root
+		{"lib/libc.so", "/lib/libc.so.7", "libc.so.7"},
+		// a link to itself or its directory stays a loop, it isn't followed
+		{"/lib/loop", "loop", "loop"},
+		{"/lib/loop", "/lib/loop", "loop"},
+		{"/lib/dir", ".", "."},
+	}
+	for _, tt := range tests {
+		if got := RebaseSymlinkTarget(tt.link, tt.target); got != tt.want {
+			t.Errorf("RebaseSymlinkTarget(%q, %q) = %q, want %q", tt.link, tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// dryRun makes run print commands instead of executing them.
+var dryRun bool
+
+// stderrTailSize bounds how much of a command's stderr a runError keeps.
+const stderrTailSize = 2048
+
+// runError describes a failed external command.
+type runError struct {
+	Command  string
+	Args     []string
+	ExitCode int // -1 if the command didn't exit normally
+	Stderr   string
+	Err      error
+}
+
+func (e *runError) Error() string {
+	msg := fmt.Sprintf("%s %s", e.Command, strings.Join(e.Args, " "))
+	if e.ExitCode >= 0 {
+		msg += fmt.Sprintf(" exited with code %d", e.ExitCode)
+	} else {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+func (e *runError) Unwrap() error {
+	return e.Err
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+// run executes a command with its output going to the console. Failures are
+// returned as *runError which includes the end of the command's stderr.
+func run(command string, args ...string) error {
+	if dryRun {
+		fmt.Printf("would run: %s %s\n", command, strings.Join(args, " "))
+		return nil
+	}
+	stderr := &tailBuffer{max: stderrTailSize}
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	runErr := &runError{
+		Command:  command,
+		Args:     args,
+		ExitCode: -1,
+		Stderr:   strings.TrimSpace(string(stderr.buf)),
+		Err:      err,
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.Exited() {
+		runErr.ExitCode = exitErr.ExitCode()
+	}
+	return runErr
+}
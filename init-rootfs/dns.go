@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// hostResolvConf is read when no nameservers are given on the command line.
+const hostResolvConf = "/etc/resolv.conf"
+
+// maxNameservers is the number of nameserver lines musl's resolver uses.
+const maxNameservers = 3
+
+// dnsConfig is what gets written to the guest /etc/resolv.conf.
+type dnsConfig struct {
+	Nameservers []string
+	Search      []string
+}
+
+// parseDNSConfig parses comma-separated nameserver IPs and search domains.
+// Without nameservers, those of the host are used (loopback ones can't be
+// reached from the VM), and DEFAULT_DNS_SERVER if none remain.
+func parseDNSConfig(nameservers, search string) (dnsConfig, error) {
+	var dns dnsConfig
+	for _, ns := range splitList(nameservers) {
+		addr, err := netip.ParseAddr(ns)
+		if err != nil {
+			return dnsConfig{}, fmt.Errorf("invalid nameserver %q: %w", ns, err)
+		}
+		dns.Nameservers = append(dns.Nameservers, addr.String())
+	}
+	for _, domain := range splitList(search) {
+		if strings.ContainsAny(domain, " \t") {
+			return dnsConfig{}, fmt.Errorf("invalid search domain %q", domain)
+		}
+		dns.Search = append(dns.Search, domain)
+	}
+
+	if len(dns.Nameservers) == 0 {
+		host, err := readHostResolvConf(hostResolvConf)
+		if err != nil {
+			fmt.Printf("Could not read host resolvers, using %s: %v\n", DEFAULT_DNS_SERVER, err)
+		}
+		dns.Nameservers = host.Nameservers
+		if len(dns.Search) == 0 {
+			dns.Search = host.Search
+		}
+	}
+	if len(dns.Nameservers) == 0 {
+		dns.Nameservers = []string{DEFAULT_DNS_SERVER}
+	}
+	if len(dns.Nameservers) > maxNameservers {
+		fmt.Printf("Warning: only the first %d nameservers are used by the guest\n", maxNameservers)
+	}
+	return dns, nil
+}
+
+// readHostResolvConf returns the usable nameservers and the search domains
+// of a resolv.conf file.
+func readHostResolvConf(path string) (dnsConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return dnsConfig{}, err
+	}
+	defer f.Close()
+
+	var dns dnsConfig
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			addr, err := netip.ParseAddr(fields[1])
+			if err != nil || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+				continue
+			}
+			dns.Nameservers = append(dns.Nameservers, addr.String())
+		case "search", "domain":
+			// the last search or domain line wins
+			dns.Search = fields[1:]
+		}
+	}
+	return dns, scanner.Err()
+}
+
+func (d dnsConfig) resolvConf() string {
+	var b strings.Builder
+	if len(d.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(d.Search, " "))
+	}
+	for _, ns := range d.Nameservers {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	return b.String()
+}
+
+func splitList(list string) []string {
+	var items []string
+	for item := range strings.SplitSeq(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"anylinuxfs/init-rootfs/vmrunner"
+
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+)
+
+type checkResult struct {
+	name string
+	err  error
+	hint string
+}
+
+func writableCheck(cfg *Config) checkResult {
+	return checkResult{
+		name: "User store is writable",
+		err:  checkWritable(cfg.UserStore),
+		hint: fmt.Sprintf("make sure %s is owned by your user (not root)", cfg.UserStore),
+	}
+}
+
+func hypervisorCheck() checkResult {
+	return checkResult{
+		name: "Hypervisor is usable by libkrun",
+		err:  vmrunner.Check(),
+		hint: "anylinuxfs needs an Apple Silicon Mac; if this is one, reinstall it to restore the hypervisor entitlement",
+	}
+}
+
+// preflight runs the checks provisioning can't succeed without, so that
+// problems are reported before the image download rather than after it.
+// Only failures are printed.
+func preflight(cfg *Config) bool {
+	ok := true
+	for _, r := range []checkResult{writableCheck(cfg), hypervisorCheck()} {
+		if r.err != nil {
+			ok = false
+			r.print()
+		}
+	}
+	return ok
+}
+
+// runDoctor performs preflight checks of the host environment and prints
+// a pass/fail checklist. Returns false if any of the checks failed. Large
+// rootfs files are only hashed if full is set.
+func runDoctor(cfg *Config, full bool) bool {
+	libexecDir := filepath.Join(cfg.PrefixDir, "libexec")
+
+	results := []checkResult{
+		writableCheck(cfg),
+		hypervisorCheck(),
+		{
+			name: "Kernel image is present",
+			err:  checkKernel(cfg.KernelPath),
+			hint: "reinstall anylinuxfs to restore the bundled kernel (or fix the -kernel path)",
+		},
+		{
+			name: "gvproxy is present",
+			err:  checkFile(filepath.Join(libexecDir, "gvproxy"), true),
+			hint: "reinstall anylinuxfs to restore the bundled gvproxy",
+		},
+		{
+			name: "vmproxy is present",
+			err:  checkVmproxy(cfg.VmproxyPath),
+			hint: "reinstall anylinuxfs to restore the bundled vmproxy (or fix the -vmproxy path)",
+		},
+		{
+			name: "Port 111 (rpcbind) is free",
+			err:  checkPortFree(111),
+			hint: "stop the host rpcbind service or any other anylinuxfs instance",
+		},
+		{
+			name: "Port 2049 (nfsd) is free",
+			err:  checkPortFree(2049),
+			hint: "stop the host NFS server (sudo nfsd stop) or any other anylinuxfs instance",
+		},
+		{
+			name: "Rootfs matches the downloaded image",
+			err:  checkRootfs(cfg),
+			hint: "run `anylinuxfs init` to reinitialize the VM environment",
+		},
+		{
+			name: "Rootfs was provisioned by this installation",
+			err:  checkMetadata(cfg),
+			hint: "run `anylinuxfs init` after upgrading anylinuxfs or changing the kernel",
+		},
+		{
+			name: "Rootfs files match their provisioning checksums",
+			err:  checkRootfsFiles(cfg, full),
+			hint: "run `anylinuxfs init` to reinstall them (a partial download or disk corruption)",
+		},
+	}
+
+	ok := true
+	for _, r := range results {
+		if r.err != nil {
+			ok = false
+		}
+		r.print()
+	}
+	return ok
+}
+
+func (r checkResult) print() {
+	if r.err == nil {
+		fmt.Printf("[ OK ] %s\n", r.name)
+		return
+	}
+	fmt.Printf("[FAIL] %s: %v\n", r.name, r.err)
+	fmt.Printf("       hint: %s\n", r.hint)
+}
+
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func checkFile(path string, executable bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if executable && info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+func checkKernel(path string) error {
+	if err := checkFile(path, false); err != nil {
+		return err
+	}
+	return checkKernelImage(path)
+}
+
+func checkVmproxy(path string) error {
+	if err := checkFile(path, true); err != nil {
+		return err
+	}
+	return checkVmproxyBinary(path)
+}
+
+func checkPortFree(port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return fmt.Errorf("port %d is already in use", port)
+		}
+		// lacking permission to bind doesn't mean the port is taken
+		return nil
+	}
+	return l.Close()
+}
+
+func checkRootfs(cfg *Config) error {
+	if _, err := os.Stat(cfg.RootfsPath); err != nil {
+		return err
+	}
+
+	engine, err := dir.Open(cfg.ImageOciPath)
+	if err != nil {
+		return fmt.Errorf("open image layout: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	paths, err := engineExt.ResolveReference(context.Background(), cfg.Tag)
+	if err != nil {
+		return fmt.Errorf("resolve tag %s: %w", cfg.Tag, err)
+	}
+	if len(paths) != 1 {
+		return fmt.Errorf("tag %s resolves to %d manifests", cfg.Tag, len(paths))
+	}
+	expected := paths[0].Descriptor().Digest
+
+	meta, err := umoci.ReadBundleMeta(cfg.ImageBasePath)
+	if err != nil {
+		return fmt.Errorf("read unpack metadata: %w", err)
+	}
+	if actual := meta.From.Descriptor().Digest; actual != expected {
+		return fmt.Errorf("rootfs was unpacked from %s but the image is %s", actual, expected)
+	}
+	return nil
+}
+
+func checkRootfsFiles(cfg *Config, full bool) error {
+	meta, err := readMetadata(cfg)
+	if err != nil {
+		return err
+	}
+	return verifyRootfsFiles(cfg, meta, full)
+}
+
+// checkMetadata detects a rootfs left over from a different anylinuxfs
+// version or kernel (whose modules were copied into the rootfs).
+func checkMetadata(cfg *Config) error {
+	meta, err := readMetadata(cfg)
+	if err != nil {
+		return err
+	}
+	if meta.ToolVersion != toolVersion {
+		return fmt.Errorf("rootfs was created by version %s, this is %s", meta.ToolVersion, toolVersion)
+	}
+	kernelSum, err := fileSHA256(cfg.KernelPath)
+	if err != nil {
+		return err
+	}
+	if meta.KernelSHA256 != kernelSum {
+		return fmt.Errorf("rootfs was created for a different kernel (%s)", meta.KernelPath)
+	}
+	return nil
+}
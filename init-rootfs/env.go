@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// guestEnvPath is where the rootfs keeps variables for entrypoint.sh.
+const guestEnvPath = "/etc/anylinuxfs/entrypoint.env"
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// guestEnv holds KEY=VALUE pairs for the guest entrypoint. It implements
+// flag.Value so -guest-env can be repeated.
+type guestEnv map[string]string
+
+func (e guestEnv) String() string {
+	return strings.Join(e.names(), ",")
+}
+
+func (e guestEnv) Set(kv string) error {
+	name, value, ok := strings.Cut(kv, "=")
+	if !ok {
+		return fmt.Errorf("expected KEY=VALUE, got %q", kv)
+	}
+	if !envNameRe.MatchString(name) {
+		return fmt.Errorf("invalid environment variable name %q", name)
+	}
+	if strings.ContainsAny(value, "\x00\n") {
+		return fmt.Errorf("value of %s must not contain newlines or NUL bytes", name)
+	}
+	e[name] = value
+	return nil
+}
+
+func (e guestEnv) names() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// loadFile reads KEY=VALUE lines from path (if it exists) into e.
+// Empty lines and lines starting with # are ignored.
+func (e guestEnv) loadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := e.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeGuestEnv stores the variables in the rootfs. The file is only
+// readable by root because values may be secrets; only the names are printed.
+// Without variables, a file left by an earlier run is removed.
+func writeGuestEnv(cfg *Config, env guestEnv) error {
+	path := filepath.Join(cfg.RootfsPath, guestEnvPath)
+	if len(env) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error removing %s: %v\n", path, err)
+			return err
+		}
+		return nil
+	}
+	var buf strings.Builder
+	for _, name := range env.names() {
+		fmt.Fprintf(&buf, "%s=%s\n", name, shellQuote(env[name]))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		fmt.Printf("Error creating %s: %v\n", filepath.Dir(path), err)
+		return err
+	}
+	if err := os.WriteFile(path, []byte(buf.String()), 0600); err != nil {
+		fmt.Printf("Error writing %s: %v\n", path, err)
+		return err
+	}
+	fmt.Printf("Guest environment variables: %s\n", env)
+	return nil
+}
+
+// withEntrypointPrelude makes entrypoint.sh export the variables from
+// guestEnvPath and run the post-mount hook (if installed) before anything
+// else runs.
+func withEntrypointPrelude(script []byte) []byte {
+	prelude := fmt.Sprintf("[ -f %[1]s ] && set -a && . %[1]s && set +a\n", guestEnvPath) + mountHookRunner
+	if !bytes.HasPrefix(script, []byte("#!")) {
+		return append([]byte(prelude), script...)
+	}
+	shebang, rest, _ := bytes.Cut(script, []byte("\n"))
+	out := append(slices.Clip(shebang), '\n')
+	out = append(out, prelude...)
+	return append(out, rest...)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// mountHookName is looked up in the user's scripts directory.
+	mountHookName = "post-mount.sh"
+	// mountHookPath is where the hook is installed in the rootfs.
+	mountHookPath = "/etc/anylinuxfs/hooks/post-mount.sh"
+	// mountHookTimeout (seconds) keeps a stuck hook from blocking the mount.
+	mountHookTimeout = 300
+	mountHookMaxSize = 1024 * 1024
+)
+
+// mountHookRunner runs the hook from entrypoint.sh, i.e. after vmproxy has
+// mounted the filesystem and before the NFS server exports it. Its output
+// goes to the console streamed to the host; a non-zero exit status (or the
+// timeout) exits entrypoint.sh before the NFS server starts, so nothing is
+// exported. vmproxy does not watch entrypoint.sh, so the failure is only
+// reported on the console.
+var mountHookRunner = fmt.Sprintf(`if [ -x %[1]s ]; then
+	echo "Running post-mount hook"
+	timeout %[2]d %[1]s || { echo "post-mount hook failed (status $?)" >&2; exit 1; }
+fi
+`, mountHookPath, mountHookTimeout)
+
+// validateMountHook rejects hooks that can't be run as an executable or that
+// other users could have tampered with, since the hook runs as root in the VM.
+func validateMountHook(path string, content []byte, info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("%s is writable by group or others", path)
+	}
+	if info.Size() > mountHookMaxSize {
+		return fmt.Errorf("%s is larger than %d bytes", path, mountHookMaxSize)
+	}
+	if !bytes.HasPrefix(content, []byte("#!")) {
+		return fmt.Errorf("%s must start with a #! interpreter line", path)
+	}
+	return nil
+}
+
+// installMountHook copies the user's post-mount hook into the rootfs, or
+// removes a previously installed one the user has since deleted.
+func installMountHook(cfg *Config) error {
+	src := scriptOverridePath(cfg, mountHookName)
+	dst := filepath.Join(cfg.RootfsPath, mountHookPath)
+
+	info, err := os.Lstat(src)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.Remove(dst); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("Error removing old post-mount hook: %v\n", err)
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("Error reading post-mount hook: %v\n", err)
+		return err
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		fmt.Printf("Error reading post-mount hook: %v\n", err)
+		return err
+	}
+	if err := validateMountHook(src, content, info); err != nil {
+		fmt.Printf("Error: invalid post-mount hook: %v\n", err)
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		fmt.Printf("Error creating %s: %v\n", filepath.Dir(dst), err)
+		return err
+	}
+	if err := os.WriteFile(dst, content, 0700); err != nil {
+		fmt.Printf("Error installing post-mount hook: %v\n", err)
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	if err := os.Chmod(dst, 0700); err != nil {
+		return err
+	}
+	fmt.Printf("Installed post-mount hook from %s\n", src)
+	return nil
+}
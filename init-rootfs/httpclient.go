@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"anylinuxfs/common-go/ratelimit"
+
+	"go.podman.io/image/v5/types"
+)
+
+// caBundlePath returns the user-supplied CA bundle which is trusted by all
+// network fetches on the host (in addition to being appended to the rootfs).
+func caBundlePath(cfg *Config) string {
+	return filepath.Join(cfg.UserStore, "ca-certificates.crt")
+}
+
+// proxyFunc selects the proxy for outgoing requests. An explicitly configured
+// proxy URL takes precedence; otherwise HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// from the environment apply.
+func proxyFunc(cfg *Config) func(*url.URL) (*url.URL, error) {
+	if cfg.ProxyURL != nil {
+		return func(*url.URL) (*url.URL, error) { return cfg.ProxyURL, nil }
+	}
+	return func(reqURL *url.URL) (*url.URL, error) {
+		return http.ProxyFromEnvironment(&http.Request{URL: reqURL})
+	}
+}
+
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+	}
+	return u, nil
+}
+
+// newHTTPClient builds the client used for all plain HTTP downloads.
+func newHTTPClient(cfg *Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	proxy := proxyFunc(cfg)
+	transport.Proxy = func(req *http.Request) (*url.URL, error) { return proxy(req.URL) }
+
+	certs, err := os.ReadFile(caBundlePath(cfg))
+	if err == nil && len(certs) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("load system cert pool: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(certs) {
+			fmt.Printf("No usable certificates found in %s\n", caBundlePath(cfg))
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	if cfg.DownloadLimiter != nil {
+		// the overall timeout would cut off throttled downloads
+		transport.ResponseHeaderTimeout = 30 * time.Second
+		return &http.Client{
+			Transport: ratelimit.Transport(transport, cfg.DownloadLimiter),
+		}, nil
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   30 * time.Second,
+	}, nil
+}
+
+// registryContext configures the container image transport with the same
+// proxy and CA settings as newHTTPClient.
+func registryContext(cfg *Config) *types.SystemContext {
+	sys := &types.SystemContext{
+		OSChoice: "linux",
+		// pick the guest's architecture from multi-arch images even when
+		// running under Rosetta
+		ArchitectureChoice: guestArch,
+		DockerProxy:        proxyFunc(cfg),
+	}
+	// DockerCertPath takes a directory and trusts every *.crt file in it
+	if _, err := os.Stat(caBundlePath(cfg)); err == nil {
+		sys.DockerCertPath = filepath.Dir(caBundlePath(cfg))
+	}
+	return sys
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/pkg/idtools"
+)
+
+// parseIDMappings parses a comma-separated list of container:host:size
+// ranges (the same triplets as /etc/subuid entries prefixed with the
+// container ID), e.g. "0:100000:65536" or "0:501:1,1:100000:65535".
+func parseIDMappings(spec string) ([]specs.LinuxIDMapping, error) {
+	var mappings []specs.LinuxIDMapping
+	for _, part := range strings.Split(spec, ",") {
+		m, err := idtools.ParseMapping(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID mapping %q: %w", part, err)
+		}
+		if m.Size == 0 {
+			return nil, fmt.Errorf("invalid ID mapping %q: size must be positive", part)
+		}
+		for _, other := range mappings {
+			if m.ContainerID < other.ContainerID+other.Size && other.ContainerID < m.ContainerID+m.Size {
+				return nil, fmt.Errorf("ID mapping %q overlaps with %d:%d:%d", part, other.ContainerID, other.HostID, other.Size)
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// unpackMapOptions returns the ID mappings for umoci. By default the image
+// root is mapped to the current user and the unpack is rootless: other
+// owners are recorded in user.rootlesscontainers xattrs. Custom mappings
+// need real chown(2), i.e. root.
+func unpackMapOptions(cfg *Config) (uidMap, gidMap []specs.LinuxIDMapping, rootless bool, err error) {
+	if cfg.UIDMappings == "" && cfg.GIDMappings == "" {
+		uid := specs.LinuxIDMapping{ContainerID: 0, HostID: uint32(os.Geteuid()), Size: 1}
+		gid := specs.LinuxIDMapping{ContainerID: 0, HostID: uint32(os.Getegid()), Size: 1}
+		return []specs.LinuxIDMapping{uid}, []specs.LinuxIDMapping{gid}, true, nil
+	}
+	if os.Geteuid() != 0 {
+		return nil, nil, false, fmt.Errorf("custom ID mappings require running as root")
+	}
+	if cfg.UIDMappings == "" || cfg.GIDMappings == "" {
+		return nil, nil, false, fmt.Errorf("both UID and GID mappings must be given")
+	}
+	if uidMap, err = parseIDMappings(cfg.UIDMappings); err != nil {
+		return nil, nil, false, err
+	}
+	if gidMap, err = parseIDMappings(cfg.GIDMappings); err != nil {
+		return nil, nil, false, err
+	}
+	return uidMap, gidMap, false, nil
+}
+
+// mappedOwner returns the image owner of a file unpacked with custom ID
+// mappings, i.e. its real owner mapped back to container IDs. Host IDs
+// outside the mappings (files written after the unpack as the current
+// user) are presented as root.
+func mappedOwner(info fs.FileInfo, uidMap, gidMap []specs.LinuxIDMapping) (uid, gid uint32) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	if id, err := idtools.ToContainer(int(st.Uid), uidMap); err == nil {
+		uid = uint32(id)
+	}
+	if id, err := idtools.ToContainer(int(st.Gid), gidMap); err == nil {
+		gid = uint32(id)
+	}
+	return uid, gid
+}
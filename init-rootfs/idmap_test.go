@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/layer"
+)
+
+func TestParseIDMappings(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []specs.LinuxIDMapping
+		wantErr bool
+	}{
+		{"0:100000:65536", []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}, false},
+		{"0:501:1, 1:100000:65535", []specs.LinuxIDMapping{
+			{ContainerID: 0, HostID: 501, Size: 1},
+			{ContainerID: 1, HostID: 100000, Size: 65535},
+		}, false},
+		// host ranges may overlap, only container IDs must be unique
+		{"0:100000:10,10:100000:10", []specs.LinuxIDMapping{
+			{ContainerID: 0, HostID: 100000, Size: 10},
+			{ContainerID: 10, HostID: 100000, Size: 10},
+		}, false},
+		{"0:100000:10,0:200000:10", nil, true},
+		{"0:100000:10,5:200000:10", nil, true},
+		{"5:100000:10,0:200000:10", nil, true},
+		{"0:100000:65536,1000:200000:1", nil, true},
+		{"0:100000:0", nil, true},
+		// the size defaults to 1
+		{"0:100000", []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 1}}, false},
+		{"0:100000:1:1", nil, true},
+		{"root:100000:1", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseIDMappings(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseIDMappings(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIDMappings(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestUnpackLayerWithIDMappings(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("custom ID mappings require root")
+	}
+	entries := []tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "var/mail/", Typeflag: tar.TypeDir, Mode: 02775, Uid: 8, Gid: 12},
+		{Name: "home/user/", Typeflag: tar.TypeDir, Mode: 0700, Uid: 1000, Gid: 1000},
+		{Name: "home/user/.profile", Typeflag: tar.TypeSymlink, Linkname: "/etc/profile", Uid: 1000, Gid: 1000},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(t)
+	cfg.UIDMappings = "0:100000:65536"
+	cfg.GIDMappings = "0:200000:65536"
+	opts, err := rootfsUnpackOptions(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := layer.UnpackLayer(cfg.RootfsPath, &buf, &opts); err != nil {
+		t.Fatal(err)
+	}
+	// written after the unpack by the current user, outside the mappings
+	if err := os.WriteFile(filepath.Join(cfg.RootfsPath, "etc/resolv.conf"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, uid, gid, hostUID, hostGID uint32) {
+		t.Helper()
+		info, err := os.Lstat(filepath.Join(cfg.RootfsPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if st.Uid != hostUID || st.Gid != hostGID {
+			t.Errorf("%s is owned by %d:%d on the host, want %d:%d", name, st.Uid, st.Gid, hostUID, hostGID)
+		}
+		gotUID, gotGID := mappedOwner(info, opts.MapOptions.UIDMappings, opts.MapOptions.GIDMappings)
+		if gotUID != uid || gotGID != gid {
+			t.Errorf("mappedOwner(%s) = %d:%d, want %d:%d", name, gotUID, gotGID, uid, gid)
+		}
+	}
+	for _, hdr := range entries {
+		uid, gid := uint32(hdr.Uid), uint32(hdr.Gid)
+		check(hdr.Name, uid, gid, 100000+uid, 200000+gid)
+	}
+	check("etc/resolv.conf", 0, 0, 0, 0)
+}
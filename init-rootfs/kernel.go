@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// kernelPathEnv overrides the bundled kernel when -kernel is not given.
+const kernelPathEnv = "ANYLINUXFS_KERNEL"
+
+// arm64 Image header (see Documentation/arch/arm64/booting.rst in the Linux tree)
+const (
+	arm64ImageMagicOffset = 0x38
+	arm64ImageHeaderSize  = 64
+)
+
+var arm64ImageMagic = []byte("ARM\x64")
+
+func bundledKernelPath(prefixDir string) string {
+	return filepath.Join(prefixDir, "libexec", "Image")
+}
+
+// checkKernelImage makes sure path is an uncompressed arm64 Linux Image
+// which is what libkrun expects.
+func checkKernelImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hdr := make([]byte, arm64ImageHeaderSize)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return fmt.Errorf("%s is too short to be a kernel image: %w", path, err)
+	}
+	if !bytes.Equal(hdr[arm64ImageMagicOffset:arm64ImageMagicOffset+4], arm64ImageMagic) {
+		return fmt.Errorf("%s is not an uncompressed arm64 kernel Image", path)
+	}
+	return nil
+}
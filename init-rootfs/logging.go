@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	logFileName     = "init-rootfs.log"
+	logMaxFileSize  = 4 * 1024 * 1024
+	logMaxFileCount = 5 // caps total size at logMaxFileSize * logMaxFileCount
+)
+
+// rotatingWriter appends to dir/name and rotates the file once it grows past
+// maxSize, keeping at most maxFiles generations (name, name.1, ... name.N-1).
+type rotatingWriter struct {
+	mu       sync.Mutex
+	dir      string
+	name     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingWriter(dir, name string, maxSize int64, maxFiles int) (*rotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create log directory %s: %w", dir, err)
+	}
+	w := &rotatingWriter{dir: dir, name: name, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) path(generation int) string {
+	if generation == 0 {
+		return filepath.Join(w.dir, w.name)
+	}
+	return filepath.Join(w.dir, fmt.Sprintf("%s.%d", w.name, generation))
+}
+
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path(0), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) rotate() error {
+	w.file.Close()
+	_ = os.Remove(w.path(w.maxFiles - 1))
+	for gen := w.maxFiles - 2; gen >= 0; gen-- {
+		_ = os.Rename(w.path(gen), w.path(gen+1))
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", level)
+	}
+	return l, nil
+}
+
+// setupLogging writes a structured log to <userStore>/logs. Everything the
+// process (including the libkrun guest console) prints to stdout/stderr keeps
+// going to the terminal but is also recorded in the log file line by line.
+// The returned function flushes the log and restores the original streams.
+func setupLogging(userStore string, level slog.Level) (func(), error) {
+	out, err := newRotatingWriter(filepath.Join(userStore, "logs"), logFileName, logMaxFileSize, logMaxFileCount)
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: level}))
+	slog.SetDefault(logger)
+
+	var wg sync.WaitGroup
+	var restore []func()
+	for _, stream := range []struct {
+		name string
+		fd   int
+	}{{"stdout", 1}, {"stderr", 2}} {
+		undo, err := teeFd(stream.fd, stream.name, logger, &wg)
+		if err != nil {
+			logger.Warn("console capture unavailable", "stream", stream.name, "error", err)
+			continue
+		}
+		restore = append(restore, undo)
+	}
+
+	logger.Info("init-rootfs started", "args", strings.Join(os.Args[1:], " "))
+
+	return func() {
+		for _, undo := range restore {
+			undo()
+		}
+		wg.Wait()
+		out.Close()
+	}, nil
+}
+
+// teeFd replaces fd with a pipe whose contents are copied both to the
+// original destination and to the logger. Redirecting at the descriptor
+// level (rather than swapping os.Stdout) also catches output written by C code.
+func teeFd(fd int, name string, logger *slog.Logger, wg *sync.WaitGroup) (func(), error) {
+	saved, err := dupFd(fd)
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := redirectFd(int(w.Fd()), fd); err != nil {
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+
+	orig := os.NewFile(uintptr(saved), name)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer r.Close()
+		scanner := bufio.NewScanner(io.TeeReader(r, orig))
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			logger.Log(context.Background(), consoleLevel(name, line), "console", "stream", name, "line", line)
+		}
+		// keep draining so writers never block on a full pipe
+		_, _ = io.Copy(orig, r)
+	}()
+
+	return func() {
+		_ = redirectFd(saved, fd)
+		w.Close()
+	}, nil
+}
+
+// consoleLevel picks the log level of a captured console line. Our own
+// errors and warnings go to stdout with fmt.Printf, so they are recognised
+// by their prefix; anything else written to stderr is at least a warning.
+func consoleLevel(stream, line string) slog.Level {
+	switch {
+	case strings.HasPrefix(line, "Error"), strings.HasPrefix(line, "Failed"):
+		return slog.LevelError
+	case strings.HasPrefix(line, "Warning"), stream == "stderr":
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
@@ -1,40 +1,53 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/x509"
+	"debug/elf"
 	_ "embed"
+	"encoding/hex"
 	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"anylinuxfs/init-rootfs/vmrunner"
+	"anylinuxfs/common-go/ratelimit"
+	"anylinuxfs/common-go/rootfs"
 
 	"github.com/BurntSushi/toml"
-	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/cas/dir"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
-	"github.com/opencontainers/umoci/pkg/idtools"
 	"go.podman.io/image/v5/copy"
 	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/manifest"
 	"go.podman.io/image/v5/oci/layout"
 	"go.podman.io/image/v5/signature"
-	"go.podman.io/image/v5/types"
+	"golang.org/x/time/rate"
 )
 
 const DEFAULT_DNS_SERVER = "1.1.1.1"
 
+// guestArch is the only architecture libkrun can run on Apple Silicon.
+const guestArch = "arm64"
+
 type Config struct {
 	ImageName         string
 	ImageBasePath     string
@@ -43,7 +56,31 @@ type Config struct {
 	RootfsPath        string
 	VmSetupScriptPath string
 	PrefixDir         string
-	UserStore         string
+	KernelPath        string
+	// VmproxyPath is the guest agent copied into the rootfs
+	VmproxyPath string
+	// MaxParallelDownloads limits concurrently pulled layers (0 = library default)
+	MaxParallelDownloads uint
+	// UIDMappings and GIDMappings override the rootless single-ID mapping
+	// (see parseIDMappings for the format)
+	UIDMappings string
+	GIDMappings string
+	// ForceUnpack discards an existing rootfs even if it's up to date
+	ForceUnpack bool
+	// FullRefresh also discards the downloaded image layout, so that no
+	// blobs are reused (implies ForceUnpack)
+	FullRefresh bool
+	UserStore   string
+	ProxyURL    *url.URL
+	// DownloadLimiter is shared by the image pull and plain HTTP downloads
+	// (nil = unlimited)
+	DownloadLimiter *rate.Limiter
+	// EntrypointURL replaces the default entrypoint.sh for development.
+	// The download must match EntrypointSHA256 unless EntrypointInsecure
+	// is set explicitly.
+	EntrypointURL      string
+	EntrypointSHA256   string
+	EntrypointInsecure bool
 }
 
 type Preferences struct {
@@ -52,6 +89,9 @@ type Preferences struct {
 
 type AlpineConfig struct {
 	CustomPackages []string `toml:"custom_packages"`
+	// Repositories are extra /etc/apk/repositories lines, e.g.
+	// "@edge https://dl-cdn.alpinelinux.org/alpine/edge/community"
+	Repositories []string `toml:"repositories"`
 }
 
 // baseDirFromDockerRef derives a filesystem-safe directory name from a docker
@@ -65,7 +105,17 @@ func baseDirFromDockerRef(imageName, tag string) string {
 	return ref
 }
 
-func defaultConfig(userHomeDir, execDir, dockerRef, baseDir string) Config {
+// vmproxyPathEnv overrides the bundled vmproxy when -vmproxy is not given.
+const vmproxyPathEnv = "ANYLINUXFS_VMPROXY"
+
+// userStoreEnv relocates the user store (image cache, rootfs, logs).
+const userStoreEnv = "ANYLINUXFS_HOME"
+
+func defaultUserStore(userHomeDir string) string {
+	return filepath.Join(userHomeDir, ".anylinuxfs")
+}
+
+func defaultConfig(userStore, execDir, dockerRef, baseDir string) Config {
 	// Parse docker reference into image name and tag.
 	imageName := dockerRef
 	tag := "latest"
@@ -78,7 +128,6 @@ func defaultConfig(userHomeDir, execDir, dockerRef, baseDir string) Config {
 		baseDir = baseDirFromDockerRef(imageName, tag)
 	}
 
-	userStore := filepath.Join(userHomeDir, ".anylinuxfs")
 	imageBasePath := filepath.Join(userStore, baseDir)
 	imageOciPath := filepath.Join(imageBasePath, "oci")
 	rootfsPath := filepath.Join(imageBasePath, "rootfs")
@@ -101,28 +150,32 @@ func defaultConfig(userHomeDir, execDir, dockerRef, baseDir string) Config {
 		RootfsPath:        rootfsPath,
 		VmSetupScriptPath: vmSetupScriptPath,
 		PrefixDir:         prefixDir,
+		KernelPath:        bundledKernelPath(prefixDir),
+		VmproxyPath:       filepath.Join(prefixDir, "libexec", "vmproxy"),
 		UserStore:         userStore,
 	}
 }
 
-func downloadImage(cfg *Config) error {
+// downloadImage copies the image into the OCI layout and returns the digest
+// of the manifest it resolved to.
+func downloadImage(ctx context.Context, cfg *Config) (digest.Digest, error) {
 	// Define source and destination
 	srcRef, err := docker.ParseReference(fmt.Sprintf("//%s:%s", cfg.ImageName, cfg.Tag))
 	if err != nil {
 		fmt.Println("Error parsing source reference:", err)
-		return err
+		return "", err
 	}
 
 	err = os.MkdirAll(cfg.ImageBasePath, 0755)
 	if err != nil {
 		fmt.Println("Error creating bundle directory:", err)
-		return err
+		return "", err
 	}
 
 	destRef, err := layout.ParseReference(fmt.Sprintf("%s:%s", cfg.ImageOciPath, cfg.Tag))
 	if err != nil {
 		fmt.Println("Error parsing destination reference:", err)
-		return err
+		return "", err
 	}
 
 	policy := &signature.Policy{
@@ -133,57 +186,139 @@ func downloadImage(cfg *Config) error {
 	policyCtx, err := signature.NewPolicyContext(policy)
 	if err != nil {
 		fmt.Println("Error creating policy context:", err)
-		return err
+		return "", err
 	}
 	defer policyCtx.Destroy()
 
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	timeout := pullTimeout
+	if cfg.DownloadLimiter != nil {
+		// a throttled pull legitimately takes longer
+		timeout, err = throttledPullTimeout(ctx, cfg, srcRef)
+		if err != nil {
+			fmt.Println("Error reading image manifest:", err)
+			return "", err
+		}
+		destRef = throttledReference{ImageReference: destRef, limiter: cfg.DownloadLimiter}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	// Download image
-	_, err = copy.Image(ctx, policyCtx, destRef, srcRef, &copy.Options{
-		ReportWriter: os.Stdout,
-		SourceCtx: &types.SystemContext{
-			OSChoice: "linux",
-		},
+	manifestBytes, err := copy.Image(ctx, policyCtx, destRef, srcRef, &copy.Options{
+		ReportWriter:         os.Stdout,
+		SourceCtx:            registryContext(cfg),
+		MaxParallelDownloads: cfg.MaxParallelDownloads,
 	})
 	if err != nil {
 		fmt.Println("Error copying image:", err)
-		return err
+		return "", err
+	}
+	return manifest.Digest(manifestBytes)
+}
+
+// checkImageArchitecture rejects an image built for a different architecture
+// (e.g. a single-arch amd64 tag) before it gets unpacked, since the VM
+// would only fail to boot it later.
+func checkImageArchitecture(cfg *Config) error {
+	engine, err := dir.Open(cfg.ImageOciPath)
+	if err != nil {
+		return fmt.Errorf("open image layout: %w", err)
+	}
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	ctx := context.Background()
+	paths, err := engineExt.ResolveReference(ctx, cfg.Tag)
+	if err != nil {
+		return fmt.Errorf("resolve tag %s: %w", cfg.Tag, err)
+	}
+	if len(paths) != 1 {
+		return fmt.Errorf("tag %s resolves to %d manifests", cfg.Tag, len(paths))
+	}
+	manifestBlob, err := engineExt.FromDescriptor(ctx, paths[0].Descriptor())
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	defer manifestBlob.Close()
+	imageManifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		return fmt.Errorf("unexpected manifest type %s", manifestBlob.Descriptor.MediaType)
+	}
+	configBlob, err := engineExt.FromDescriptor(ctx, imageManifest.Config)
+	if err != nil {
+		return fmt.Errorf("read image config: %w", err)
+	}
+	defer configBlob.Close()
+	imageConfig, ok := configBlob.Data.(ispec.Image)
+	if !ok {
+		return fmt.Errorf("unexpected image config type %s", configBlob.Descriptor.MediaType)
+	}
+
+	if imageConfig.OS != "linux" || imageConfig.Architecture != guestArch {
+		return fmt.Errorf("image %s:%s is built for %s/%s, but the VM can only run linux/%s images",
+			cfg.ImageName, cfg.Tag, imageConfig.OS, imageConfig.Architecture, guestArch)
 	}
 	return nil
 }
 
-func unpackImage(cfg *Config) error {
+// rootfsIsCurrent reports whether the existing rootfs was unpacked from the
+// image with the given manifest digest (recorded by umoci in umoci.json) and
+// its provisioning finished (recorded in metadata.json).
+func rootfsIsCurrent(cfg *Config, imageDigest digest.Digest) bool {
+	bundleMeta, err := umoci.ReadBundleMeta(cfg.ImageBasePath)
+	if err != nil || bundleMeta.From.Descriptor().Digest != imageDigest {
+		return false
+	}
+	meta, err := readMetadata(cfg)
+	if err != nil || meta.ImageDigest != imageDigest.String() {
+		return false
+	}
+	_, err = os.Stat(cfg.RootfsPath)
+	return err == nil
+}
+
+// pruneImageLayout removes blobs no longer referenced by any tag in the
+// layout, e.g. layers of a previous version of the image.
+func pruneImageLayout(cfg *Config) error {
 	engine, err := dir.Open(cfg.ImageOciPath)
 	if err != nil {
-		fmt.Printf("Error opening image: %v\n", err)
 		return err
 	}
-
-	engineExt := casext.NewEngine(engine)
 	defer engine.Close()
+	return casext.NewEngine(engine).GC(context.Background())
+}
 
-	uidMap, err := idtools.ParseMapping(fmt.Sprintf("0:%d:1", os.Geteuid()))
+// rootfsUnpackOptions returns the options shared with freebsd-bootstrap
+// (see rootfs.UnpackOptions) with the ID mappings of unpackMapOptions.
+func rootfsUnpackOptions(cfg *Config) (layer.UnpackOptions, error) {
+	uidMap, gidMap, rootless, err := unpackMapOptions(cfg)
 	if err != nil {
-		fmt.Printf("Error parsing UID mapping: %v\n", err)
+		return layer.UnpackOptions{}, err
+	}
+	return rootfs.UnpackOptions(layer.MapOptions{
+		UIDMappings: uidMap,
+		GIDMappings: gidMap,
+		Rootless:    rootless,
+	}), nil
+}
+
+func unpackImage(cfg *Config) error {
+	engine, err := dir.Open(cfg.ImageOciPath)
+	if err != nil {
+		fmt.Printf("Error opening image: %v\n", err)
 		return err
 	}
 
-	gidMap, err := idtools.ParseMapping(fmt.Sprintf("0:%d:1", os.Getegid()))
+	engineExt := casext.NewEngine(engine)
+	defer engine.Close()
+
+	unpackOptions, err := rootfsUnpackOptions(cfg)
 	if err != nil {
-		fmt.Printf("Error parsing GID mapping: %v\n", err)
+		fmt.Printf("Error setting up ID mappings: %v\n", err)
 		return err
 	}
 
-	err = umoci.Unpack(engineExt, cfg.Tag, cfg.ImageBasePath, layer.UnpackOptions{
-		MapOptions: layer.MapOptions{
-			UIDMappings: []specs.LinuxIDMapping{uidMap},
-			GIDMappings: []specs.LinuxIDMapping{gidMap},
-			Rootless:    true,
-		},
-	})
+	err = umoci.Unpack(engineExt, cfg.Tag, cfg.ImageBasePath, unpackOptions)
 	if err != nil {
 		fmt.Printf("Error unpacking image: %v\n", err)
 		return err
@@ -195,16 +330,18 @@ func unpackImage(cfg *Config) error {
 	return nil
 }
 
-func configureDNS(rootfsPath, nameserver string) error {
+func configureDNS(rootfsPath string, dns dnsConfig) error {
 	resolvConfPath := fmt.Sprintf("%s/etc/resolv.conf", rootfsPath)
 
-	if nameserver == "" {
-		// Fallback default if somehow empty
-		nameserver = DEFAULT_DNS_SERVER
+	// a set up rootfs links it to /tmp/resolv.conf (see vm-setup.sh), which
+	// must not be followed to the host's /tmp
+	if info, err := os.Lstat(resolvConfPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(resolvConfPath); err != nil {
+			fmt.Printf("Error removing resolv.conf symlink: %v\n", err)
+			return err
+		}
 	}
-
-	resolvConfContent := fmt.Sprintf("nameserver %s\n", nameserver)
-	err := os.WriteFile(resolvConfPath, []byte(resolvConfContent), 0644)
+	err := os.WriteFile(resolvConfPath, []byte(dns.resolvConf()), 0644)
 	if err != nil {
 		fmt.Printf("Error writing to resolv.conf: %v\n", err)
 		return err
@@ -225,6 +362,9 @@ func appendCaCerts(cfg *Config) error {
 		return nil
 	}
 
+	// a reused rootfs may already contain the certificates
+	existing, _ := os.ReadFile(caCertPath)
+
 	f, err := os.OpenFile(caCertPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return err
@@ -242,6 +382,10 @@ func appendCaCerts(cfg *Config) error {
 				continue
 			}
 
+			if bytes.Contains(existing, pem.EncodeToMemory(block)) {
+				continue
+			}
+
 			err = pem.Encode(f, block)
 			if err != nil {
 				fmt.Printf("Encountered error while writing CA certificate to %s. Skipping...\n", caCertPath)
@@ -304,17 +448,21 @@ func getDefaultPackages() []string {
 	return packages
 }
 
+func loadPreferences(userStore string) (Preferences, error) {
+	var preferences Preferences
+	_, err := toml.DecodeFile(filepath.Join(userStore, "config.toml"), &preferences)
+	return preferences, err
+}
+
 func loadCustomPackages(userStore string) []string {
 	configPath := filepath.Join(userStore, "config.toml")
 
-	// Check if config file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+	preferences, err := loadPreferences(userStore)
+	if os.IsNotExist(err) {
 		fmt.Printf("Config file not found at %s, using default packages only\n", configPath)
 		return []string{}
 	}
-
-	var preferences Preferences
-	if _, err := toml.DecodeFile(configPath, &preferences); err != nil {
+	if err != nil {
 		fmt.Printf("Error reading config file %s: %v, using default packages only\n", configPath, err)
 		return []string{}
 	}
@@ -323,6 +471,71 @@ func loadCustomPackages(userStore string) []string {
 	return preferences.Alpine.CustomPackages
 }
 
+// parseRepository validates an apk repository line: an http(s) URL,
+// optionally preceded by an @tag for pinned repositories.
+func parseRepository(line string) (string, error) {
+	fields := strings.Fields(line)
+	repoURL := ""
+	switch {
+	case len(fields) == 1:
+		repoURL = fields[0]
+	case len(fields) == 2 && strings.HasPrefix(fields[0], "@") && len(fields[0]) > 1:
+		repoURL = fields[1]
+	default:
+		return "", fmt.Errorf("invalid repository %q (expected [@tag] URL)", line)
+	}
+	u, err := url.Parse(repoURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid repository URL %q", repoURL)
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// addApkRepositories appends the configured repositories (not already
+// present) to /etc/apk/repositories so vm-setup.sh can install from them.
+func addApkRepositories(cfg *Config) error {
+	// a missing or broken config.toml is reported by loadCustomPackages
+	preferences, err := loadPreferences(cfg.UserStore)
+	if err != nil || len(preferences.Alpine.Repositories) == 0 {
+		return nil
+	}
+
+	reposPath := filepath.Join(cfg.RootfsPath, "etc", "apk", "repositories")
+	existing, err := os.ReadFile(reposPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error reading %s: %v\n", reposPath, err)
+		return err
+	}
+	present := strings.Split(string(existing), "\n")
+
+	var add []string
+	for _, line := range preferences.Alpine.Repositories {
+		repo, err := parseRepository(line)
+		if err != nil {
+			fmt.Printf("Error in config.toml: %v\n", err)
+			return err
+		}
+		if !slices.Contains(present, repo) && !slices.Contains(add, repo) {
+			add = append(add, repo)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+
+	content := string(existing)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	content += strings.Join(add, "\n") + "\n"
+	if err := os.WriteFile(reposPath, []byte(content), 0644); err != nil {
+		fmt.Printf("Error writing %s: %v\n", reposPath, err)
+		return err
+	}
+	fmt.Printf("Added %d apk repositories from config\n", len(add))
+	return nil
+}
+
 func writeSetupScript(cfg *Config, setupScript string) error {
 	// Load custom packages from config
 	customPackages := loadCustomPackages(cfg.UserStore)
@@ -335,23 +548,16 @@ func writeSetupScript(cfg *Config, setupScript string) error {
 	packagesStr := strings.Join(allPackages, " ")
 
 	vmSetupScriptPath := fmt.Sprintf("%s%s", cfg.RootfsPath, cfg.VmSetupScriptPath)
-	vmSetupScriptContent := fmt.Sprintf(`#!/bin/sh
-
-%s
-apk --update --no-cache add %s
-MOD_PATH="modules/$(uname -r)"
-cd /lib
-mkdir -p $MOD_PATH
-unsquashfs -mem 32M -d $MOD_PATH modules.squashfs
-rm modules.squashfs
-depmod -a
-ln -sf /tmp/resolv.conf /etc/resolv.conf
-rm -v /etc/idmapd.conf /etc/exports
-ln -sf /tmp/exports /etc/exports
-mkdir /.config /.cache
-`, setupScript, packagesStr)
-
-	err := os.WriteFile(vmSetupScriptPath, []byte(vmSetupScriptContent), 0755)
+	vmSetupScriptContent, err := renderScript(cfg, "vm-setup.sh", vmSetupScriptTemplate, struct {
+		SetupScript string
+		Packages    string
+	}{setupScript, packagesStr})
+	if err != nil {
+		fmt.Printf("Error generating vm-setup.sh: %v\n", err)
+		return err
+	}
+
+	err = os.WriteFile(vmSetupScriptPath, vmSetupScriptContent, 0755)
 	if err != nil {
 		fmt.Printf("Error writing vm-setup.sh: %v\n", err)
 		return err
@@ -363,52 +569,150 @@ mkdir /.config /.cache
 	return nil
 }
 
-func downloadEntrypointScript(rootfsPath string) error {
-	entrypointScriptURL := "https://raw.githubusercontent.com/nohajc/docker-nfs-server/refs/heads/develop/entrypoint.sh"
-	entrypointScriptPath := fmt.Sprintf("%s/usr/local/bin/entrypoint.sh", rootfsPath)
-
-	entrypointScriptFile, err := os.OpenFile(entrypointScriptPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+// installEntrypointScript writes the NFS server launcher (see
+// entrypointScript) to the rootfs.
+func installEntrypointScript(ctx context.Context, cfg *Config) error {
+	content, err := entrypointScript(ctx, cfg)
 	if err != nil {
-		fmt.Printf("Error creating entrypoint.sh: %v\n", err)
+		fmt.Printf("Error getting entrypoint.sh: %v\n", err)
 		return err
 	}
-	defer entrypointScriptFile.Close()
-
-	resp, err := http.Get(entrypointScriptURL)
+	// the prelude is added after verification so the pinned digest still
+	// refers to the upstream script
+	entrypointScriptPath := filepath.Join(cfg.RootfsPath, "usr/local/bin/entrypoint.sh")
+	err = os.WriteFile(entrypointScriptPath, withEntrypointPrelude(content), 0755)
 	if err != nil {
-		fmt.Printf("Error downloading entrypoint.sh: %v\n", err)
+		fmt.Printf("Error saving entrypoint.sh: %v\n", err)
 		return err
 	}
+	return nil
+}
+
+// The NFS server launcher provisioned by default. build-app.sh pins both
+// at build time (ENTRYPOINT_URL and ENTRYPOINT_SHA256), so every install
+// of a build writes the same script. A build without a digest refuses the
+// download unless -insecure-entrypoint is passed.
+var (
+	defaultEntrypointURL    = "https://raw.githubusercontent.com/nohajc/docker-nfs-server/refs/heads/develop/entrypoint.sh"
+	defaultEntrypointSHA256 = ""
+)
+
+// entrypointScript returns the user's copy of entrypoint.sh if there is one
+// in the user store, otherwise the one from cfg.EntrypointURL if set (for
+// development) and the pinned default otherwise.
+func entrypointScript(ctx context.Context, cfg *Config) ([]byte, error) {
+	overridePath := scriptOverridePath(cfg, "entrypoint.sh")
+	content, err := os.ReadFile(overridePath)
+	if err == nil {
+		fmt.Printf("Using entrypoint.sh from %s\n", overridePath)
+		return content, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read %s: %w", overridePath, err)
+	}
+
+	url, digest := defaultEntrypointURL, defaultEntrypointSHA256
+	if cfg.EntrypointURL != "" {
+		url, digest = cfg.EntrypointURL, cfg.EntrypointSHA256
+	}
+	client, err := newHTTPClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("set up HTTP client: %w", err)
+	}
+	return downloadEntrypointScript(ctx, client, url, digest, cfg.EntrypointInsecure)
+}
+
+// downloadEntrypointScript fetches entrypoint.sh from url and verifies it
+// against the expected SHA-256 digest. Without a digest it refuses to
+// download anything unless insecure is set.
+func downloadEntrypointScript(ctx context.Context, client *http.Client, url, digest string, insecure bool) ([]byte, error) {
+	if digest == "" && !insecure {
+		return nil, fmt.Errorf("refusing to use entrypoint.sh from %s without a checksum (pin ENTRYPOINT_SHA256 in the build or pass -entrypoint-sha256, or -insecure-entrypoint for development)", url)
+	}
+	fmt.Printf("Downloading entrypoint.sh from %s\n", url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Printf("Failed to download entrypoint.sh, status code: %d\n", resp.StatusCode)
-		return err
+		return nil, fmt.Errorf("download %s: unexpected HTTP status %s", url, resp.Status)
 	}
 
-	_, err = io.Copy(entrypointScriptFile, resp.Body)
+	content, err := io.ReadAll(resp.Body)
 	if err != nil {
-		fmt.Printf("Error saving entrypoint.sh: %v\n", err)
-		return err
+		return nil, err
 	}
 
-	return nil
+	if digest == "" {
+		fmt.Printf("Warning: entrypoint.sh from %s is not verified (-insecure-entrypoint)\n", url)
+		return content, nil
+	}
+	sum := sha256.Sum256(content)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, digest) {
+		return nil, fmt.Errorf("entrypoint.sh checksum mismatch: expected %s, got %s", digest, actual)
+	}
+	return content, nil
 }
 
+// copyFile copies a regular file, preserving its permission bits.
 func copyFile(srcPath, dstPath string) error {
-	copyCmd := exec.Command("cp", "-v", srcPath, dstPath)
-	copyCmd.Stdout = os.Stdout
-	copyCmd.Stderr = os.Stderr
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("copy %s to %s: %w", srcPath, dstPath, err)
+	}
+	// an existing file keeps its mode and new ones are subject to umask
+	if err := os.Chmod(dstPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	fmt.Printf("%s -> %s\n", srcPath, dstPath)
+	return nil
+}
 
-	return copyCmd.Run()
+// checkVmproxyBinary makes sure path is a Linux executable for the guest
+// architecture, since a mismatched vmproxy only fails once the VM boots.
+func checkVmproxyBinary(path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s is not an ELF executable: %w", path, err)
+	}
+	defer f.Close()
+	if f.Class != elf.ELFCLASS64 || f.Machine != elf.EM_AARCH64 {
+		return fmt.Errorf("%s is built for %v %v, the VM needs %v", path, f.Class, f.Machine, elf.EM_AARCH64)
+	}
+	return nil
 }
 
-func copyVmproxyBinary(prefixDir, rootfsPath string) error {
-	vmproxyBin := "vmproxy"
-	vmproxySrcPath := filepath.Join(prefixDir, "libexec", vmproxyBin)
-	vmproxyDstPath := filepath.Join(rootfsPath, vmproxyBin)
+func copyVmproxyBinary(cfg *Config) error {
+	vmproxyDstPath := filepath.Join(cfg.RootfsPath, "vmproxy")
 
-	err := copyFile(vmproxySrcPath, vmproxyDstPath)
+	if err := checkVmproxyBinary(cfg.VmproxyPath); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return err
+	}
+	err := copyFile(cfg.VmproxyPath, vmproxyDstPath)
 	if err != nil {
 		fmt.Printf("Error copying vmproxy: %v\n", err)
 		return err
@@ -431,40 +735,64 @@ func copyLinuxModules(prefixDir, rootfsPath string) error {
 	return nil
 }
 
-func initRootfs(cfg *Config, nameserver string, setupScript string) error {
-	if _, err := os.Stat(cfg.ImageBasePath); err == nil {
-		err = os.RemoveAll(cfg.ImageBasePath)
-		if err != nil {
-			fmt.Printf("Error removing existing directory %s: %v\n", cfg.ImageBasePath, err)
+// initRootfs provisions the rootfs described by cfg (a staging directory,
+// see provisionRootfs). current is the live configuration whose rootfs may
+// be taken over instead of unpacking the image again.
+func initRootfs(ctx context.Context, cfg, current *Config, dns dnsConfig, setupScript string, env guestEnv) error {
+	imageDigest, err := downloadImage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := checkImageArchitecture(cfg); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return err
+	}
+
+	if err := pruneImageLayout(cfg); err != nil {
+		// stale blobs only waste space
+		fmt.Printf("Warning: could not prune image layout: %v\n", err)
+	}
+
+	if !cfg.ForceUnpack && rootfsIsCurrent(current, imageDigest) {
+		fmt.Printf("Rootfs is already unpacked from %s, skipping unpack\n", imageDigest)
+		if err := moveBundle(current, cfg); err != nil {
+			return err
+		}
+	} else {
+		if err := unpackImage(cfg); err != nil {
 			return err
 		}
 	}
 
-	if err := downloadImage(cfg); err != nil {
+	if err := configureDNS(cfg.RootfsPath, dns); err != nil {
 		return err
 	}
 
-	if err := unpackImage(cfg); err != nil {
+	if err := appendCaCerts(cfg); err != nil {
 		return err
 	}
 
-	if err := configureDNS(cfg.RootfsPath, nameserver); err != nil {
+	if err := configureFstab(cfg.RootfsPath); err != nil {
 		return err
 	}
 
-	if err := appendCaCerts(cfg); err != nil {
+	if err := addApkRepositories(cfg); err != nil {
 		return err
 	}
 
-	if err := configureFstab(cfg.RootfsPath); err != nil {
+	if err := writeSetupScript(cfg, setupScript); err != nil {
 		return err
 	}
 
-	if err := writeSetupScript(cfg, setupScript); err != nil {
+	if err := installEntrypointScript(ctx, cfg); err != nil {
+		return err
+	}
+
+	if err := writeGuestEnv(cfg, env); err != nil {
 		return err
 	}
 
-	if err := downloadEntrypointScript(cfg.RootfsPath); err != nil {
+	if err := installMountHook(cfg); err != nil {
 		return err
 	}
 
@@ -472,20 +800,25 @@ func initRootfs(cfg *Config, nameserver string, setupScript string) error {
 		return err
 	}
 
-	if err := copyVmproxyBinary(cfg.PrefixDir, cfg.RootfsPath); err != nil {
+	if err := copyVmproxyBinary(cfg); err != nil {
 		return err
 	}
 
 	// Stamp libkrun's user.containers.override_stat xattr on every entry so
-	// the macOS virtiofs driver presents the rootfs to the guest as owned by
-	// root:root. No-op on non-macOS hosts (build-tag stub). Run last so it
+	// the macOS virtiofs driver presents the rootfs to the guest with the
+	// image owners. No-op on non-macOS hosts (build-tag stub). Run last so it
 	// also catches everything earlier steps wrote to the rootfs.
-	if err := stampOverrideStat(cfg.RootfsPath); err != nil {
+	unpackOptions, err := rootfsUnpackOptions(cfg)
+	if err != nil {
+		fmt.Printf("Error setting up ID mappings: %v\n", err)
+		return err
+	}
+	if err := stampOverrideStat(cfg.RootfsPath, unpackOptions.MapOptions); err != nil {
 		fmt.Printf("Error stamping override_stat xattrs: %v\n", err)
 		return err
 	}
 
-	return nil
+	return writeMetadata(cfg, imageDigest.String())
 }
 
 func resolveExecDir() (string, error) {
@@ -503,46 +836,193 @@ func resolveExecDir() (string, error) {
 }
 
 func main() {
+	if len(os.Args) == 5 && os.Args[1] == setupVMCommand {
+		os.Exit(runSetupVM(os.Args[2], os.Args[3], os.Args[4]))
+	}
+	os.Exit(run())
+}
+
+func run() int {
 	// Don't let the invoker's umask leak into the rootfs perms; with e.g.
 	// umask 037 the rootfs root would be drwxr----- and any privilege-dropping
 	// daemon in the guest (rpcbind drops to user `rpc`) would lose traversal.
 	syscall.Umask(0o022)
 
-	var nameserver string
+	var nameservers string
+	var searchDomains string
 	var dockerRef string
 	var baseDir string
 	var setupScript string
-	flag.StringVar(&nameserver, "n", DEFAULT_DNS_SERVER, "Nameserver IP to write into /etc/resolv.conf")
+	var logLevel string
+	var doctor bool
+	var showVersion bool
+	var fullCheck bool
+	env := guestEnv{}
+	var proxy string
+	var entrypointURL string
+	var entrypointSHA256 string
+	var entrypointInsecure bool
+	var kernelPath string
+	var vmproxyPath string
+	var parallelDownloads uint
+	var maxDownloadRate int64
+	var forceUnpack bool
+	var fullRefresh bool
+	var uidMap, gidMap string
+	var store string
+	flag.StringVar(&nameservers, "n", "", "Comma-separated nameserver IPs to write into /etc/resolv.conf (default: the host's resolvers, or "+DEFAULT_DNS_SERVER+")")
+	flag.StringVar(&searchDomains, "search", "", "Comma-separated DNS search domains for /etc/resolv.conf (default: the host's if -n is not given)")
 	flag.StringVar(&dockerRef, "docker-ref", "alpine:latest", "Docker/OCI image reference (e.g. alpine:latest, alpine:edge)")
 	flag.StringVar(&baseDir, "base-dir", "", "Base directory name under ~/.anylinuxfs/ (derived from docker-ref if empty)")
 	flag.StringVar(&setupScript, "setup-script", "", "Shell command(s) to run inside the VM before package installation")
+	flag.StringVar(&logLevel, "log-level", "info", "Level of the log file written to ~/.anylinuxfs/logs (debug, info, warn, error)")
+	flag.StringVar(&proxy, "proxy", "", "Proxy URL for all downloads (overrides HTTPS_PROXY/HTTP_PROXY)")
+	flag.StringVar(&entrypointURL, "entrypoint-url", "", "Fetch entrypoint.sh from this URL instead of the pinned default (for development, requires -entrypoint-sha256 or -insecure-entrypoint)")
+	flag.StringVar(&entrypointSHA256, "entrypoint-sha256", "", "Expected SHA-256 digest (hex) of the script fetched with -entrypoint-url")
+	flag.BoolVar(&entrypointInsecure, "insecure-entrypoint", false, "Use entrypoint.sh without verifying its checksum (development only)")
+	flag.StringVar(&kernelPath, "kernel", os.Getenv(kernelPathEnv), "Boot the setup VM with this arm64 kernel Image instead of the bundled one (default $"+kernelPathEnv+")")
+	flag.StringVar(&vmproxyPath, "vmproxy", os.Getenv(vmproxyPathEnv), "Copy this vmproxy binary into the rootfs instead of the bundled one (default $"+vmproxyPathEnv+")")
+	flag.Var(env, "guest-env", "KEY=VALUE exported to the guest entrypoint.sh (repeatable, adds to ~/.anylinuxfs/guest.env)")
+	flag.UintVar(&parallelDownloads, "parallel-downloads", 0, "Maximum number of image layers pulled at the same time (0 = default of 6)")
+	flag.Int64Var(&maxDownloadRate, "max-download-rate", 0, "Cap the image and package downloads at this many bytes per second (0 = unlimited)")
+	flag.StringVar(&uidMap, "uid-map", "", "UID mappings for unpacking as container:host:size[,...] (requires root, default maps 0 to the current user)")
+	flag.StringVar(&gidMap, "gid-map", "", "GID mappings for unpacking as container:host:size[,...] (requires root, default maps 0 to the current group)")
+	flag.StringVar(&store, "store", os.Getenv(userStoreEnv), "User store directory (default ~/.anylinuxfs or $"+userStoreEnv+")")
+	flag.BoolVar(&forceUnpack, "force-unpack", false, "Unpack a fresh rootfs even if the existing one matches the image")
+	flag.BoolVar(&fullRefresh, "full-refresh", false, "Discard the downloaded image too and pull all layers again (by default unchanged layers are reused)")
+	flag.BoolVar(&showVersion, "version", false, "Print the tool version and metadata of the initialized rootfs, then exit")
+	flag.BoolVar(&doctor, "doctor", false, "Check the host environment and the initialized rootfs, then exit")
+	flag.BoolVar(&fullCheck, "full", false, "With -doctor or -version, also verify the checksums of large rootfs files")
 	flag.Parse()
 
+	level, err := parseLogLevel(logLevel)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	proxyURL, err := parseProxyURL(proxy)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	dns, err := parseDNSConfig(nameservers, searchDomains)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
 	execDir, err := resolveExecDir()
 	if err != nil {
 		fmt.Printf("Error resolving exec dir: %v\n", err)
-		os.Exit(1)
+		return 1
+	}
+	if store == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			fmt.Printf("Error getting current user: %v\n", err)
+			return 1
+		}
+		if currentUser.HomeDir == "" {
+			fmt.Println("Current user does not have a home directory.")
+			return 1
+		}
+		store = defaultUserStore(currentUser.HomeDir)
 	}
-	currentUser, err := user.Current()
+	store, err = filepath.Abs(store)
 	if err != nil {
-		fmt.Printf("Error getting current user: %v\n", err)
-		os.Exit(1)
+		fmt.Printf("Error resolving user store path: %v\n", err)
+		return 1
+	}
+	cfg := defaultConfig(store, execDir, dockerRef, baseDir)
+	cfg.ProxyURL = proxyURL
+	cfg.MaxParallelDownloads = parallelDownloads
+	cfg.DownloadLimiter = ratelimit.New(maxDownloadRate)
+	cfg.ForceUnpack = forceUnpack || fullRefresh
+	cfg.FullRefresh = fullRefresh
+	cfg.UIDMappings = uidMap
+	cfg.GIDMappings = gidMap
+	if _, _, _, err := unpackMapOptions(&cfg); err != nil {
+		fmt.Printf("Error in ID mappings: %v\n", err)
+		return 1
+	}
+	if entrypointURL == "" && entrypointSHA256 != "" {
+		fmt.Println("-entrypoint-sha256 requires -entrypoint-url")
+		return 1
+	}
+	if entrypointSHA256 != "" {
+		if sum, err := hex.DecodeString(entrypointSHA256); err != nil || len(sum) != sha256.Size {
+			fmt.Printf("Invalid -entrypoint-sha256 %q: expected 64 hex digits\n", entrypointSHA256)
+			return 1
+		}
+	}
+	cfg.EntrypointURL = entrypointURL
+	cfg.EntrypointSHA256 = entrypointSHA256
+	cfg.EntrypointInsecure = entrypointInsecure
+	if kernelPath != "" {
+		cfg.KernelPath = kernelPath
+		if err := checkKernelImage(cfg.KernelPath); err != nil {
+			fmt.Printf("Error using custom kernel: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Kernel: %s\n", cfg.KernelPath)
 	}
-	if currentUser.HomeDir == "" {
-		fmt.Println("Current user does not have a home directory.")
-		os.Exit(1)
+	if vmproxyPath != "" {
+		cfg.VmproxyPath = vmproxyPath
+		if err := checkVmproxy(cfg.VmproxyPath); err != nil {
+			fmt.Printf("Error using custom vmproxy: %v\n", err)
+			return 1
+		}
+		fmt.Printf("vmproxy: %s\n", cfg.VmproxyPath)
+	}
+
+	// variables given on the command line take precedence over the file
+	fileEnv := guestEnv{}
+	if err := fileEnv.loadFile(filepath.Join(cfg.UserStore, "guest.env")); err != nil {
+		fmt.Printf("Error reading guest environment: %v\n", err)
+		return 1
 	}
-	cfg := defaultConfig(currentUser.HomeDir, execDir, dockerRef, baseDir)
+	maps.Copy(fileEnv, env)
+	env = fileEnv
 
-	err = initRootfs(&cfg, nameserver, setupScript)
+	if showVersion {
+		printVersion(&cfg, fullCheck)
+		return 0
+	}
+
+	if doctor {
+		if !runDoctor(&cfg, fullCheck) {
+			return 1
+		}
+		return 0
+	}
+
+	if !preflight(&cfg) {
+		return 1
+	}
+
+	closeLog, err := setupLogging(cfg.UserStore, level)
 	if err != nil {
-		os.Exit(1)
+		// logging is best effort, provisioning can continue without it
+		fmt.Printf("Warning: could not set up log file: %v\n", err)
+		closeLog = func() {}
 	}
+	// also called by the signal handler, which may race with the return
+	closeLog = sync.OnceFunc(closeLog)
+	defer closeLog()
+	slog.Debug("resolved config", "image", cfg.ImageName, "tag", cfg.Tag, "rootfs", cfg.RootfsPath, "prefix", cfg.PrefixDir, "kernel", cfg.KernelPath)
 
-	kernelPath := filepath.Join(cfg.PrefixDir, "libexec", "Image")
-	err = vmrunner.Run(kernelPath, cfg.RootfsPath, cfg.VmSetupScriptPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(cancel, closeLog)
+
+	err = provisionRootfs(ctx, &cfg, dns, setupScript, env)
 	if err != nil {
-		fmt.Printf("Failed to run VM: %v\n", err)
-		os.Exit(1)
+		slog.Error("rootfs provisioning failed", "error", err)
+		if ctx.Err() != nil {
+			return exitInterrupted
+		}
+		return 1
 	}
+	slog.Info("rootfs provisioned", "rootfs", cfg.RootfsPath)
+	return 0
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func entrypointServer(t *testing.T, status int, body string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestEntrypointDownloadNotFound(t *testing.T) {
+	srv := entrypointServer(t, http.StatusNotFound, "404: Not Found")
+	cfg := testConfig(t)
+	cfg.EntrypointURL = srv.URL + "/entrypoint.sh"
+	cfg.EntrypointInsecure = true
+
+	err := installEntrypointScript(context.Background(), cfg)
+	if err == nil {
+		t.Fatal("provisioning succeeded with a 404 entrypoint.sh")
+	}
+	for _, want := range []string{cfg.EntrypointURL, "404 Not Found"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.RootfsPath, "usr/local/bin/entrypoint.sh")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("entrypoint.sh was written despite the failed download (stat: %v)", err)
+	}
+}
+
+func TestEntrypointDownloadChecksum(t *testing.T) {
+	const script = "#!/bin/sh\nexec nfsd\n"
+	sum := sha256.Sum256([]byte(script))
+	srv := entrypointServer(t, http.StatusOK, script)
+
+	tests := []struct {
+		name     string
+		digest   string
+		insecure bool
+		wantErr  string
+	}{
+		{name: "matching digest", digest: hex.EncodeToString(sum[:])},
+		{name: "mismatch", digest: strings.Repeat("0", 64), wantErr: "checksum mismatch"},
+		{name: "no digest", wantErr: "without a checksum"},
+		{name: "explicitly insecure", insecure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.EntrypointURL = srv.URL + "/entrypoint.sh"
+			cfg.EntrypointSHA256 = tt.digest
+			cfg.EntrypointInsecure = tt.insecure
+
+			err := installEntrypointScript(context.Background(), cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readRootfsFile(t, cfg, "usr/local/bin/entrypoint.sh")
+			if want := withEntrypointPrelude([]byte(script)); string(got) != string(want) {
+				t.Errorf("entrypoint.sh = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestConfigureDNSReplacesSymlink(t *testing.T) {
+	cfg := testConfig(t)
+	// stands in for the host's /tmp/resolv.conf the guest symlink points to
+	outside := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(outside, []byte("nameserver 192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.RootfsPath, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(cfg.RootfsPath, "etc/resolv.conf")); err != nil {
+		t.Fatal(err)
+	}
+
+	dns, err := parseDNSConfig("1.1.1.1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := configureDNS(cfg.RootfsPath, dns); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(outside); string(got) != "nameserver 192.0.2.1\n" {
+		t.Errorf("file behind the symlink was overwritten: %q", got)
+	}
+	info, err := os.Lstat(filepath.Join(cfg.RootfsPath, "etc/resolv.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Errorf("resolv.conf is %v, want a regular file", info.Mode())
+	}
+	if got := readRootfsFile(t, cfg, "etc/resolv.conf"); string(got) != dns.resolvConf() {
+		t.Errorf("resolv.conf = %q, want %q", got, dns.resolvConf())
+	}
+}
+
+func TestWriteGuestEnvRemovesStaleFile(t *testing.T) {
+	cfg := testConfig(t)
+	if err := writeGuestEnv(cfg, guestEnv{"NFS_VERSION": "4"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readRootfsFile(t, cfg, guestEnvPath); string(got) != "NFS_VERSION='4'\n" {
+		t.Errorf("entrypoint.env = %q", got)
+	}
+	if err := writeGuestEnv(cfg, guestEnv{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.RootfsPath, guestEnvPath)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("entrypoint.env left behind without variables (stat: %v)", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// toolVersion is set at build time by build-app.sh (-ldflags -X).
+var toolVersion = "dev"
+
+const metadataFileName = "metadata.json"
+
+// RootfsMetadata records what a rootfs was provisioned from, so bug reports
+// and the doctor check can tell which image, kernel and tool produced it.
+type RootfsMetadata struct {
+	ToolVersion  string `json:"tool_version"`
+	ImageRef     string `json:"image_ref"`
+	ImageDigest  string `json:"image_digest"`
+	KernelPath   string `json:"kernel_path"`
+	KernelSHA256 string `json:"kernel_sha256"`
+	// FileSHA256 maps the checksummedFiles (relative to the rootfs) to
+	// their SHA-256 when they were installed
+	FileSHA256 map[string]string `json:"file_sha256,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// checksummedFiles are the files installed into the rootfs by init-rootfs
+// itself. Large ones are only verified on request (-full).
+var checksummedFiles = []struct {
+	path  string
+	large bool
+}{
+	{"vmproxy", false},
+	{"usr/local/bin/entrypoint.sh", false},
+	{"lib/modules.squashfs", true},
+}
+
+func metadataPath(cfg *Config) string {
+	return filepath.Join(cfg.ImageBasePath, metadataFileName)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeMetadata(cfg *Config, imageDigest string) error {
+	kernelSum, err := fileSHA256(cfg.KernelPath)
+	if err != nil {
+		fmt.Printf("Error hashing kernel image: %v\n", err)
+		return err
+	}
+	fileSums := map[string]string{}
+	for _, f := range checksummedFiles {
+		sum, err := fileSHA256(filepath.Join(cfg.RootfsPath, f.path))
+		if err != nil {
+			fmt.Printf("Error hashing %s: %v\n", f.path, err)
+			return err
+		}
+		fileSums[f.path] = sum
+	}
+	meta := RootfsMetadata{
+		ToolVersion:  toolVersion,
+		ImageRef:     cfg.ImageName + ":" + cfg.Tag,
+		ImageDigest:  imageDigest,
+		KernelPath:   cfg.KernelPath,
+		KernelSHA256: kernelSum,
+		FileSHA256:   fileSums,
+		CreatedAt:    time.Now().UTC(),
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(metadataPath(cfg), append(data, '\n'), 0644)
+	if err != nil {
+		fmt.Printf("Error writing %s: %v\n", metadataPath(cfg), err)
+		return err
+	}
+	return nil
+}
+
+func readMetadata(cfg *Config) (RootfsMetadata, error) {
+	var meta RootfsMetadata
+	data, err := os.ReadFile(metadataPath(cfg))
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("parse %s: %w", metadataPath(cfg), err)
+	}
+	return meta, nil
+}
+
+// verifyRootfsFiles compares the checksummedFiles with the checksums
+// recorded at provisioning, skipping the large ones unless full is set.
+func verifyRootfsFiles(cfg *Config, meta RootfsMetadata, full bool) error {
+	if len(meta.FileSHA256) == 0 {
+		return fmt.Errorf("no file checksums were recorded (rootfs provisioned by an older version)")
+	}
+	var errs []error
+	for _, f := range checksummedFiles {
+		expected, ok := meta.FileSHA256[f.path]
+		if !ok || (f.large && !full) {
+			continue
+		}
+		actual, err := fileSHA256(filepath.Join(cfg.RootfsPath, f.path))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if actual != expected {
+			errs = append(errs, fmt.Errorf("%s has sha256 %s, expected %s", f.path, actual, expected))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// printVersion prints the tool version and, if the rootfs was initialized,
+// the metadata recorded when it was provisioned and whether the kernel and
+// the installed files still match it.
+func printVersion(cfg *Config, full bool) {
+	fmt.Printf("init-rootfs %s\n", toolVersion)
+
+	meta, err := readMetadata(cfg)
+	if err != nil {
+		fmt.Printf("Rootfs metadata: not available (%v)\n", err)
+		return
+	}
+	fmt.Printf("Rootfs created: %s by init-rootfs %s\n", meta.CreatedAt.Format(time.RFC3339), meta.ToolVersion)
+	fmt.Printf("Image: %s@%s\n", meta.ImageRef, meta.ImageDigest)
+	fmt.Printf("Kernel: %s (sha256 %s)\n", meta.KernelPath, meta.KernelSHA256)
+	for _, f := range checksummedFiles {
+		if sum, ok := meta.FileSHA256[f.path]; ok {
+			fmt.Printf("File: %s (sha256 %s)\n", f.path, sum)
+		}
+	}
+
+	if kernelSum, err := fileSHA256(meta.KernelPath); err != nil || kernelSum != meta.KernelSHA256 {
+		fmt.Println("Warning: the kernel changed since provisioning, run `anylinuxfs init`")
+	}
+	if err := verifyRootfsFiles(cfg, meta, full); err != nil {
+		fmt.Printf("Warning: rootfs files do not match, run `anylinuxfs init`:\n%v\n", err)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/umoci/oci/layer"
+	rootlesscontainers "github.com/rootless-containers/proto/go-proto"
 	"golang.org/x/sys/unix"
 )
 
@@ -15,10 +18,11 @@ const overrideStatXattr = "user.containers.override_stat"
 
 // stampOverrideStat walks rootfsPath and writes user.containers.override_stat
 // on every entry so libkrun's macOS virtiofs presents files to the guest as
-// owned by uid 0, gid 0 with their real permission bits. Uses the 3-field
-// form ("0:0:0<octal>"); libkrun ORs in the host's real type bits at read
-// time so this value is correct for files, dirs, and symlinks alike.
-func stampOverrideStat(rootfsPath string) error {
+// owned by their image owner (see fileOwner) with their real permission
+// bits. Uses the 3-field form ("uid:gid:0<octal>"); libkrun ORs in the
+// host's real type bits at read time so this value is correct for files,
+// dirs, and symlinks alike.
+func stampOverrideStat(rootfsPath string, opts layer.MapOptions) error {
 	return filepath.WalkDir(rootfsPath, func(path string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
@@ -38,7 +42,8 @@ func stampOverrideStat(rootfsPath string) error {
 		if m&os.ModeSticky != 0 {
 			mode |= 0o1000
 		}
-		value := fmt.Sprintf("0:0:0%o", mode)
+		uid, gid := fileOwner(path, info, opts)
+		value := fmt.Sprintf("%d:%d:0%o", uid, gid, mode)
 		if err := lsetxattrWithWriteAccess(path, m, value); err != nil {
 			return fmt.Errorf("lsetxattr %s: %w", path, err)
 		}
@@ -46,6 +51,41 @@ func stampOverrideStat(rootfsPath string) error {
 	})
 }
 
+// fileOwner returns the image owner of path: recorded in an xattr by a
+// rootless unpack, otherwise the real owner mapped back through the custom
+// ID mappings.
+func fileOwner(path string, info fs.FileInfo, opts layer.MapOptions) (uid, gid uint32) {
+	if opts.Rootless {
+		return rootlessOwner(path)
+	}
+	return mappedOwner(info, opts.UIDMappings, opts.GIDMappings)
+}
+
+// rootlessOwner returns the image owner of path after a rootless unpack,
+// which creates everything as the current user (standing in for root) and
+// records any other owner in the user.rootlesscontainers xattr. A missing
+// xattr or NoopID field means root. Custom multi-range mappings need a
+// root unpack and go through mappedOwner instead.
+func rootlessOwner(path string) (uid, gid uint32) {
+	buf := make([]byte, 64)
+	n, err := unix.Lgetxattr(path, rootlesscontainers.Keyname, buf)
+	if err != nil {
+		return 0, 0
+	}
+	var res rootlesscontainers.Resource
+	if err := proto.Unmarshal(buf[:n], &res); err != nil {
+		fmt.Printf("Warning: ignoring malformed %s on %s: %v\n", rootlesscontainers.Keyname, path, err)
+		return 0, 0
+	}
+	if res.Uid != rootlesscontainers.NoopID {
+		uid = res.Uid
+	}
+	if res.Gid != rootlesscontainers.NoopID {
+		gid = res.Gid
+	}
+	return uid, gid
+}
+
 // lsetxattrWithWriteAccess sets the override_stat xattr, working around the
 // macOS requirement that setxattr needs write permission on the target. For
 // regular files and directories that lack the owner-write bit (e.g. /var/empty
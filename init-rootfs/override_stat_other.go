@@ -2,4 +2,6 @@
 
 package main
 
-func stampOverrideStat(string) error { return nil }
+import "github.com/opencontainers/umoci/oci/layer"
+
+func stampOverrideStat(string, layer.MapOptions) error { return nil }
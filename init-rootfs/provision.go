@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"anylinuxfs/init-rootfs/vmrunner"
+)
+
+// setupVMCommand is the hidden first argument with which init-rootfs
+// re-executes itself to run the setup VM. libkrun exits the process once the
+// guest stops, so the VM gets a process of its own and the staged rootfs is
+// committed by the parent after checking how the VM ended.
+const setupVMCommand = "__setup-vm"
+
+// setupDoneMarker (relative to the rootfs) is written by vm-setup.sh after
+// all of its steps succeeded.
+const setupDoneMarker = "etc/anylinuxfs/vm-setup.done"
+
+// stagingConfig returns a copy of cfg pointing to a sibling directory of
+// ImageBasePath in which a new rootfs is built.
+func stagingConfig(cfg *Config) Config {
+	staged := *cfg
+	staged.ImageBasePath = cfg.ImageBasePath + ".staging"
+	staged.ImageOciPath = filepath.Join(staged.ImageBasePath, "oci")
+	staged.RootfsPath = filepath.Join(staged.ImageBasePath, "rootfs")
+	return staged
+}
+
+// provisionRootfs builds the rootfs (including the setup VM run) in a
+// staging directory and only replaces cfg.ImageBasePath once everything
+// succeeded, so an interrupted run never leaves a half-built rootfs in
+// place. The OCI layout is carried over so that only changed layers are
+// pulled, unless cfg.FullRefresh asks to start over.
+func provisionRootfs(ctx context.Context, cfg *Config, dns dnsConfig, setupScript string, env guestEnv) error {
+	staged := stagingConfig(cfg)
+
+	// leftover of an interrupted run, whose OCI layout is still worth keeping
+	if _, err := os.Stat(cfg.ImageOciPath); os.IsNotExist(err) {
+		if err := moveIfExists(staged.ImageOciPath, cfg.ImageOciPath); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(staged.ImageBasePath); err != nil {
+		fmt.Printf("Error removing %s: %v\n", staged.ImageBasePath, err)
+		return err
+	}
+	if err := os.MkdirAll(staged.ImageBasePath, 0755); err != nil {
+		fmt.Printf("Error creating %s: %v\n", staged.ImageBasePath, err)
+		return err
+	}
+	if cfg.FullRefresh {
+		if err := os.RemoveAll(cfg.ImageOciPath); err != nil {
+			fmt.Printf("Error removing %s: %v\n", cfg.ImageOciPath, err)
+			return err
+		}
+	} else if err := moveIfExists(cfg.ImageOciPath, staged.ImageOciPath); err != nil {
+		return err
+	}
+	// also runs if a signal interrupts the build
+	unregister := cleanup.add(func() { discardStaging(&staged, cfg) })
+
+	err := buildStagedRootfs(ctx, &staged, cfg, dns, setupScript, env)
+	if err != nil {
+		cleanup.run()
+		return err
+	}
+	unregister()
+	return commitStaging(&staged, cfg)
+}
+
+func buildStagedRootfs(ctx context.Context, staged, current *Config, dns dnsConfig, setupScript string, env guestEnv) error {
+	if err := initRootfs(ctx, staged, current, dns, setupScript, env); err != nil {
+		return err
+	}
+
+	// a rootfs taken over from the live one has been set up before
+	marker := filepath.Join(staged.RootfsPath, setupDoneMarker)
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error removing %s: %v\n", marker, err)
+		return err
+	}
+	if err := startSetupVM(ctx, staged); err != nil {
+		fmt.Printf("Failed to run VM: %v\n", err)
+		slog.Error("setup VM failed", "error", err)
+		return err
+	}
+	if _, err := os.Stat(marker); err != nil {
+		err = fmt.Errorf("setup VM stopped before vm-setup.sh finished")
+		fmt.Printf("Error: %v\n", err)
+		slog.Error("setup VM failed", "error", err)
+		return err
+	}
+	slog.Info("setup VM finished")
+	return nil
+}
+
+// startSetupVM runs the setup VM in a child process (see setupVMCommand)
+// and waits for it. The child shares stdout and stderr, so the guest console
+// is shown and logged like our own output. Cancelling ctx kills the VM.
+func startSetupVM(ctx context.Context, cfg *Config) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("get executable path: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, self, setupVMCommand, cfg.KernelPath, cfg.RootfsPath, cfg.VmSetupScriptPath)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// runSetupVM is the child side of startSetupVM. It only returns if libkrun
+// fails to start the VM.
+func runSetupVM(kernelPath, rootPath, scriptPath string) int {
+	if err := vmrunner.Run(kernelPath, rootPath, scriptPath); err != nil {
+		fmt.Printf("Error starting VM: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// commitStaging swaps the staging directory into place.
+func commitStaging(staged, cfg *Config) error {
+	old := cfg.ImageBasePath + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		fmt.Printf("Error removing %s: %v\n", old, err)
+		return err
+	}
+	if err := moveIfExists(cfg.ImageBasePath, old); err != nil {
+		return err
+	}
+	if err := os.Rename(staged.ImageBasePath, cfg.ImageBasePath); err != nil {
+		fmt.Printf("Error moving rootfs into place: %v\n", err)
+		return err
+	}
+	if err := os.RemoveAll(old); err != nil {
+		// the new rootfs is in place, the old one only wastes space
+		fmt.Printf("Warning: could not remove %s: %v\n", old, err)
+	}
+	return nil
+}
+
+// discardStaging removes a failed build. The OCI layout goes back to the
+// live directory (if there still is one) so the next run can reuse it.
+func discardStaging(staged, cfg *Config) {
+	if _, err := os.Stat(cfg.ImageBasePath); err == nil {
+		if err := moveIfExists(staged.ImageOciPath, cfg.ImageOciPath); err != nil {
+			fmt.Printf("Warning: could not keep the downloaded image: %v\n", err)
+		}
+	}
+	if err := os.RemoveAll(staged.ImageBasePath); err != nil {
+		fmt.Printf("Warning: could not remove %s: %v\n", staged.ImageBasePath, err)
+	}
+}
+
+// moveBundle moves the unpacked bundle (everything but the OCI layout)
+// of src into dst.
+func moveBundle(src, dst *Config) error {
+	entries, err := os.ReadDir(src.ImageBasePath)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", src.ImageBasePath, err)
+		return err
+	}
+	for _, entry := range entries {
+		from := filepath.Join(src.ImageBasePath, entry.Name())
+		if from == src.ImageOciPath {
+			continue
+		}
+		if err := os.Rename(from, filepath.Join(dst.ImageBasePath, entry.Name())); err != nil {
+			fmt.Printf("Error moving %s: %v\n", from, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func moveIfExists(from, to string) error {
+	err := os.Rename(from, to)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error moving %s to %s: %v\n", from, to, err)
+		return err
+	}
+	return nil
+}
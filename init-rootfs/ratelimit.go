@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"anylinuxfs/common-go/ratelimit"
+
+	"go.podman.io/image/v5/types"
+	"golang.org/x/time/rate"
+)
+
+// pullTimeout is the time an unthrottled image pull may take.
+const pullTimeout = 30 * time.Second
+
+// throttledReference wraps the image pull destination. The registry client
+// builds its own transport, so the pull is throttled where blobs are written:
+// reading the stream more slowly holds back the download.
+type throttledReference struct {
+	types.ImageReference
+	limiter *rate.Limiter
+}
+
+func (r throttledReference) NewImageDestination(ctx context.Context, sys *types.SystemContext) (types.ImageDestination, error) {
+	dest, err := r.ImageReference.NewImageDestination(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return throttledDestination{ImageDestination: dest, limiter: r.limiter}, nil
+}
+
+type throttledDestination struct {
+	types.ImageDestination
+	limiter *rate.Limiter
+}
+
+func (d throttledDestination) PutBlob(ctx context.Context, stream io.Reader, inputInfo types.BlobInfo, cache types.BlobInfoCache, isConfig bool) (types.BlobInfo, error) {
+	return d.ImageDestination.PutBlob(ctx, ratelimit.Reader(ctx, d.limiter, stream), inputInfo, cache, isConfig)
+}
+
+// throttledPullTimeout extends pullTimeout by the time the image's blobs
+// take to download at the limited rate. It fetches the manifest to learn
+// their size.
+func throttledPullTimeout(ctx context.Context, cfg *Config, srcRef types.ImageReference) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, pullTimeout)
+	defer cancel()
+	img, err := srcRef.NewImage(ctx, registryContext(cfg))
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+	size := img.ConfigInfo().Size
+	for _, layer := range img.LayerInfos() {
+		size += max(layer.Size, 0)
+	}
+	return pullTimeout + ratelimit.Duration(cfg.DownloadLimiter, size), nil
+}
@@ -0,0 +1,9 @@
+//go:build darwin
+
+package main
+
+import "golang.org/x/sys/unix"
+
+func dupFd(fd int) (int, error) { return unix.Dup(fd) }
+
+func redirectFd(oldfd, newfd int) error { return unix.Dup2(oldfd, newfd) }
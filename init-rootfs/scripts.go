@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+//go:embed scripts/vm-setup.sh
+var vmSetupScriptTemplate string
+
+// scriptOverridePath returns where a user can place their own version of
+// a helper script to be used instead of the built-in one.
+func scriptOverridePath(cfg *Config, name string) string {
+	return filepath.Join(cfg.UserStore, "scripts", name)
+}
+
+// loadScript returns the user's override of a script if it exists,
+// otherwise the embedded default.
+func loadScript(cfg *Config, name, embedded string) (string, error) {
+	overridePath := scriptOverridePath(cfg, name)
+	content, err := os.ReadFile(overridePath)
+	if os.IsNotExist(err) {
+		return embedded, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", overridePath, err)
+	}
+	fmt.Printf("Using %s from %s\n", name, overridePath)
+	return string(content), nil
+}
+
+// renderScript loads a script (see loadScript) and executes it as a
+// text/template with the given data.
+func renderScript(cfg *Config, name, embedded string, data any) ([]byte, error) {
+	text, err := loadScript(cfg, name, embedded)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("render %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,36 @@
+#!/bin/sh
+
+{{.SetupScript}}
+# init-rootfs only uses the rootfs if every step below succeeds
+set -e
+NAMESERVERS=$(awk '/^nameserver/ { print $2 }' /etc/resolv.conf | xargs)
+REPO_HOST=$(sed -n 's|^https\{0,1\}://\([^/]*\)/.*|\1|p' /etc/apk/repositories | head -n 1)
+REPO_HOST=${REPO_HOST:-dl-cdn.alpinelinux.org}
+# any working nameserver will do, the resolver falls back to the next one
+DNS_OK=
+for NAMESERVER in $NAMESERVERS; do
+  if nslookup "$REPO_HOST" "$NAMESERVER" >/dev/null 2>&1; then
+    DNS_OK=1
+    break
+  fi
+done
+if [ -z "$DNS_OK" ]; then
+  echo "VM has no network/DNS: cannot resolve $REPO_HOST using nameservers ${NAMESERVERS:-(none configured)}" >&2
+  echo "Check the host network connection and the nameserver passed to init-rootfs (-n)" >&2
+  exit 1
+fi
+apk --update --no-cache add {{.Packages}}
+MOD_PATH="modules/$(uname -r)"
+cd /lib
+# a rootfs taken over from an earlier run is set up again
+rm -rf $MOD_PATH
+mkdir -p $MOD_PATH
+unsquashfs -mem 32M -d $MOD_PATH modules.squashfs
+rm modules.squashfs
+depmod -a
+ln -sf /tmp/resolv.conf /etc/resolv.conf
+rm -fv /etc/idmapd.conf /etc/exports
+ln -sf /tmp/exports /etc/exports
+mkdir -p /.config /.cache
+mkdir -p /etc/anylinuxfs
+touch /etc/anylinuxfs/vm-setup.done
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// testConfig returns a config with an empty user store and a rootfs
+// skeleton with the directories the scripts are written to.
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &Config{
+		RootfsPath:        filepath.Join(dir, "rootfs"),
+		UserStore:         filepath.Join(dir, "store"),
+		VmSetupScriptPath: "/usr/local/bin/vm-setup.sh",
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.RootfsPath, "usr/local/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func readRootfsFile(t *testing.T, cfg *Config, path string) []byte {
+	t.Helper()
+	content, err := os.ReadFile(filepath.Join(cfg.RootfsPath, path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestWrittenSetupScriptMatchesEmbedded(t *testing.T) {
+	cfg := testConfig(t)
+	if err := writeSetupScript(cfg, "echo custom"); err != nil {
+		t.Fatal(err)
+	}
+
+	var want bytes.Buffer
+	tmpl := template.Must(template.New("vm-setup.sh").Parse(vmSetupScriptTemplate))
+	err := tmpl.Execute(&want, struct {
+		SetupScript string
+		Packages    string
+	}{"echo custom", strings.Join(getDefaultPackages(), " ")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readRootfsFile(t, cfg, cfg.VmSetupScriptPath); !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("written vm-setup.sh differs from the embedded template:\n%s", got)
+	}
+}
+
+func TestWrittenEntrypointMatchesPinned(t *testing.T) {
+	const script = "#!/bin/sh\nexec rpc.nfsd\n"
+	sum := sha256.Sum256([]byte(script))
+	srv := entrypointServer(t, http.StatusOK, script)
+
+	tests := []struct {
+		name    string
+		digest  string
+		wantErr bool
+	}{
+		{"pinned", hex.EncodeToString(sum[:]), false},
+		{"other digest pinned", strings.Repeat("0", 64), true},
+		// a build without a pinned digest must not provision anything
+		{"nothing pinned", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(url, digest string) {
+				defaultEntrypointURL, defaultEntrypointSHA256 = url, digest
+			}(defaultEntrypointURL, defaultEntrypointSHA256)
+			defaultEntrypointURL = srv.URL + "/entrypoint.sh"
+			defaultEntrypointSHA256 = tt.digest
+
+			cfg := testConfig(t)
+			err := installEntrypointScript(context.Background(), cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("installed entrypoint.sh that does not match the pinned digest")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readRootfsFile(t, cfg, "usr/local/bin/entrypoint.sh")
+			if want := withEntrypointPrelude([]byte(script)); !bytes.Equal(got, want) {
+				t.Errorf("written entrypoint.sh differs from the pinned script")
+			}
+		})
+	}
+}
+
+func TestUserStoreScriptOverrides(t *testing.T) {
+	cfg := testConfig(t)
+	overrides := filepath.Join(cfg.UserStore, "scripts")
+	if err := os.MkdirAll(overrides, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"vm-setup.sh":   "#!/bin/sh\n{{.SetupScript}}\napk add {{.Packages}}\n",
+		"entrypoint.sh": "#!/bin/sh\nexec nfsd\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(overrides, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writeSetupScript(cfg, "true"); err != nil {
+		t.Fatal(err)
+	}
+	wantSetup := "#!/bin/sh\ntrue\napk add " + strings.Join(getDefaultPackages(), " ") + "\n"
+	if got := readRootfsFile(t, cfg, cfg.VmSetupScriptPath); string(got) != wantSetup {
+		t.Errorf("vm-setup.sh = %q, want %q", got, wantSetup)
+	}
+
+	if err := installEntrypointScript(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	wantEntrypoint := withEntrypointPrelude([]byte(files["entrypoint.sh"]))
+	if got := readRootfsFile(t, cfg, "usr/local/bin/entrypoint.sh"); !bytes.Equal(got, wantEntrypoint) {
+		t.Errorf("entrypoint.sh = %q, want %q", got, wantEntrypoint)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// exitInterrupted is the conventional exit code after SIGINT (128+2).
+	exitInterrupted = 130
+	// teardownTimeout bounds cleanup after a signal before exiting anyway.
+	teardownTimeout = 10 * time.Second
+)
+
+// teardown collects cleanup steps which run exactly once, whether
+// provisioning fails on its own or is interrupted by a signal.
+type teardown struct {
+	mu    sync.Mutex
+	next  int
+	funcs map[int]func()
+	once  sync.Once
+}
+
+var cleanup = &teardown{funcs: make(map[int]func())}
+
+// add registers f and returns a function unregistering it again (once the
+// state f would clean up has been committed).
+func (t *teardown) add(f func()) (remove func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := t.next
+	t.next++
+	t.funcs[id] = f
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.funcs, id)
+	}
+}
+
+// run executes the registered steps, most recent first. Concurrent and
+// repeated calls wait for the first one and do nothing else.
+func (t *teardown) run() {
+	t.once.Do(func() {
+		t.mu.Lock()
+		ids := slices.Sorted(maps.Keys(t.funcs))
+		funcs := make([]func(), 0, len(ids))
+		for _, id := range slices.Backward(ids) {
+			funcs = append(funcs, t.funcs[id])
+		}
+		t.funcs = make(map[int]func())
+		t.mu.Unlock()
+
+		for _, f := range funcs {
+			f()
+		}
+	})
+}
+
+// handleSignals cancels the context on SIGINT or SIGTERM (which also kills
+// the setup VM), runs the teardown and exits with exitInterrupted. A second
+// signal, or a teardown taking longer than teardownTimeout, exits
+// immediately. beforeExit (e.g. flushing the log) runs in either case.
+func handleSignals(cancel context.CancelFunc, beforeExit func()) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("\nReceived %v, cleaning up (send it again to exit immediately)\n", sig)
+		cancel()
+
+		done := make(chan struct{})
+		go func() {
+			cleanup.run()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-signals:
+			fmt.Println("Exiting without finishing cleanup")
+		case <-time.After(teardownTimeout):
+			fmt.Printf("Cleanup did not finish within %v, exiting\n", teardownTimeout)
+		}
+		beforeExit()
+		os.Exit(exitInterrupted)
+	}()
+}
@@ -22,7 +22,18 @@ func Run(kernelPath, rootPath, scriptPath string) error {
 	cScriptPath := C.CString(scriptPath)
 	defer C.free(unsafe.Pointer(cScriptPath))
 
-	cerr := C.setup_and_start_vm(cKernelPath, cRootPath, cScriptPath)
+	return toError(C.setup_and_start_vm(cKernelPath, cRootPath, cScriptPath))
+}
+
+// Check verifies that a VM can be started: the host must support the
+// hypervisor (kern.hv_support on macOS, /dev/kvm on Linux), this binary must
+// be allowed to use it (it creates and destroys an empty VM, which fails
+// without the hypervisor entitlement) and libkrun must create a context.
+func Check() error {
+	return toError(C.check_vm_support())
+}
+
+func toError(cerr C.error) error {
 	if cerr.code != 0 {
 		return fmt.Errorf(
 			"%s: %s (errno %d)",
@@ -7,3 +7,4 @@ typedef struct error {
 } error;
 
 error setup_and_start_vm(const char* kernel_path, const char* root_path, const char* script_path);
+error check_vm_support(void);
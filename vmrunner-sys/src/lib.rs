@@ -1,9 +1,10 @@
+use std::ffi::CStr;
 use std::os::raw::{c_char, c_int};
 use std::ptr;
 
 use krun::{
-    krun_create_ctx, krun_set_exec, krun_set_kernel, krun_set_root, krun_set_vm_config,
-    krun_set_workdir, krun_start_enter,
+    krun_create_ctx, krun_free_ctx, krun_set_exec, krun_set_kernel, krun_set_root,
+    krun_set_vm_config, krun_set_workdir, krun_start_enter,
 };
 
 #[repr(C)]
@@ -14,10 +15,14 @@ pub struct Error {
 }
 
 fn success() -> Error {
-    Error { code: 0, prefix: ptr::null(), msg: ptr::null() }
+    Error {
+        code: 0,
+        prefix: ptr::null(),
+        msg: ptr::null(),
+    }
 }
 
-fn krun_error(err: i32, prefix: &'static std::ffi::CStr) -> Error {
+fn krun_error(err: i32, prefix: &'static CStr) -> Error {
     Error {
         code: -err,
         prefix: prefix.as_ptr(),
@@ -71,3 +76,117 @@ pub unsafe extern "C" fn setup_and_start_vm(
 
     success()
 }
+
+fn check_error(code: c_int, prefix: &'static CStr, msg: &'static CStr) -> Error {
+    Error {
+        code,
+        prefix: prefix.as_ptr(),
+        msg: msg.as_ptr(),
+    }
+}
+
+#[cfg(target_os = "macos")]
+mod hv {
+    use std::ffi::c_void;
+    use std::os::raw::c_int;
+    use std::ptr;
+
+    use super::{Error, check_error, success};
+
+    // hv_return_t values from <Hypervisor/hv_error.h>
+    const HV_SUCCESS: i32 = 0;
+    const HV_DENIED: i32 = 0xfae94007_u32 as i32;
+    const HV_UNSUPPORTED: i32 = 0xfae9400f_u32 as i32;
+
+    #[link(name = "Hypervisor", kind = "framework")]
+    unsafe extern "C" {
+        fn hv_vm_create(config: *mut c_void) -> i32;
+        fn hv_vm_destroy() -> i32;
+    }
+
+    /// Checks that the host supports Hypervisor.framework and that this
+    /// process is allowed to use it, by creating and destroying a VM.
+    pub fn check() -> Error {
+        let mut supported: c_int = 0;
+        let mut size = size_of::<c_int>();
+        let res = unsafe {
+            libc::sysctlbyname(
+                c"kern.hv_support".as_ptr(),
+                &mut supported as *mut c_int as *mut c_void,
+                &mut size,
+                ptr::null_mut(),
+                0,
+            )
+        };
+        if res != 0 || supported == 0 {
+            return check_error(
+                libc::ENODEV,
+                c"hypervisor check",
+                c"Hypervisor.framework is not supported on this host (kern.hv_support is 0)",
+            );
+        }
+
+        match unsafe { hv_vm_create(ptr::null_mut()) } {
+            HV_SUCCESS => {}
+            HV_DENIED => {
+                return check_error(
+                    libc::EPERM,
+                    c"hypervisor check",
+                    c"access denied, the binary lacks the com.apple.security.hypervisor entitlement",
+                );
+            }
+            HV_UNSUPPORTED => {
+                return check_error(
+                    libc::ENODEV,
+                    c"hypervisor check",
+                    c"VM creation is not supported on this host",
+                );
+            }
+            _ => {
+                return check_error(libc::EIO, c"hypervisor check", c"failed to create a VM");
+            }
+        }
+        unsafe { hv_vm_destroy() };
+
+        success()
+    }
+}
+
+#[cfg(target_os = "linux")]
+mod hv {
+    use super::{Error, check_error, success};
+
+    /// Checks that KVM is available and accessible to this user.
+    pub fn check() -> Error {
+        let res = unsafe { libc::access(c"/dev/kvm".as_ptr(), libc::R_OK | libc::W_OK) };
+        if res != 0 {
+            return check_error(
+                std::io::Error::last_os_error()
+                    .raw_os_error()
+                    .unwrap_or(libc::ENODEV),
+                c"hypervisor check",
+                c"/dev/kvm is missing or not accessible",
+            );
+        }
+        success()
+    }
+}
+
+#[unsafe(no_mangle)]
+pub extern "C" fn check_vm_support() -> Error {
+    let err = hv::check();
+    if err.code != 0 {
+        return err;
+    }
+
+    let ctx = krun_create_ctx();
+    if ctx < 0 {
+        return krun_error(ctx, c"configuration context error");
+    }
+    let res = krun_free_ctx(ctx as u32);
+    if res < 0 {
+        return krun_error(res, c"free context error");
+    }
+
+    success()
+}